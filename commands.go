@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/eahrend/gcp-iap-tunnel-parser/iaptunnel"
+	"io"
+	"net"
+	"os"
+	"runtime/debug"
+	"strings"
+	"text/tabwriter"
+)
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+func startTunnel(ctx context.Context, args []string) error {
+	fs := newFlagSet("start-tunnel", "INSTANCE PORT")
+	var target targetFlags
+	target.register(fs)
+	localPort := envOr("LOCAL_PORT")
+	if localPort == "" {
+		localPort = "0"
+	}
+	localHostPort := fs.String("local-host-port", "localhost:"+localPort,
+		"`host:port` to listen on for clients, the port defaults to $LOCAL_PORT and 0 picks an unused one")
+	allowNonLoopback := fs.Bool("allow-non-loopback", false,
+		"allow --local-host-port to be an address other machines can reach")
+	unixSocket := fs.String("local-unix-socket", "", "`path` of a unix socket to listen on instead of --local-host-port")
+	unixSocketMode := fs.String("local-unix-socket-mode", "0600", "file `mode` of the unix socket, in octal")
+	unixSocketOwner := fs.String("local-unix-socket-owner", "", "`user[:group]` to own the unix socket, names or ids")
+	listenOnStdin := fs.Bool("listen-on-stdin", false, "tunnel stdin and stdout instead of listening on a port")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	instance, port, err := instancePort(args)
+	if err != nil {
+		return err
+	}
+	err = target.validate()
+	if err != nil {
+		return err
+	}
+	tunnelOpts, err := target.options(ctx)
+	if err != nil {
+		return err
+	}
+	tunnelOpts = append(tunnelOpts,
+		iaptunnel.WithInstanceName(instance),
+		iaptunnel.WithPort(port))
+	if *listenOnStdin {
+		return tunnelStdio(ctx, tunnelOpts)
+	}
+	var localOpts []iaptunnel.LocalConnOption
+	if *unixSocket != "" {
+		localOpts, err = unixSocketOptions(*unixSocket, *unixSocketMode, *unixSocketOwner)
+	} else {
+		localOpts, err = localHostPortOptions(*localHostPort, *allowNonLoopback)
+	}
+	if err != nil {
+		return err
+	}
+	orca, err := iaptunnel.NewOrca(ctx,
+		iaptunnel.WithTunnelConnectionOptions(tunnelOpts...),
+		iaptunnel.WithLocalConnOptions(localOpts...))
+	if errors.Is(err, iaptunnel.ErrNonLoopback) {
+		return &usageError{fmt.Errorf("%w, pass --allow-non-loopback", err)}
+	}
+	if err != nil {
+		return err
+	}
+	// the one line on stdout, so scripts can find a picked port
+	if *unixSocket != "" {
+		fmt.Printf("LOCAL_UNIX_SOCKET=%s\n", orca.Addr())
+	} else {
+		fmt.Printf("LOCAL_HOST_PORT=%s\n", orca.Addr())
+	}
+	return orca.Run(ctx)
+}
+
+// tunnelStdio tunnels stdin and stdout until either end closes. Orca
+// stays quiet since stdout is the tunnel, what went wrong is returned.
+func tunnelStdio(ctx context.Context, tunnelOpts []iaptunnel.TunnelConnectionOption) error {
+	var clientErr error
+	orca, err := iaptunnel.NewOrca(ctx,
+		iaptunnel.WithTunnelConnectionOptions(tunnelOpts...),
+		iaptunnel.WithLocalConnOptions(iaptunnel.WithLocalConnStdio()),
+		iaptunnel.WithLogWriter(io.Discard),
+		iaptunnel.WithClientErrorHandler(func(client net.Addr, err error) {
+			clientErr = err
+		}))
+	if err != nil {
+		return err
+	}
+	err = orca.Run(ctx)
+	return errors.Join(clientErr, err)
+}
+
+func sshProxy(ctx context.Context, args []string) error {
+	fs := newFlagSet("ssh-proxy", "INSTANCE PORT")
+	var target targetFlags
+	target.register(fs)
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	instance, port, err := instancePort(args)
+	if err != nil {
+		return err
+	}
+	err = target.validate()
+	if err != nil {
+		return err
+	}
+	tunnelOpts, err := target.options(ctx)
+	if err != nil {
+		return err
+	}
+	return tunnelStdio(ctx, append(tunnelOpts,
+		iaptunnel.WithInstanceName(instance),
+		iaptunnel.WithPort(port)))
+}
+
+func listTargets(ctx context.Context, args []string) error {
+	fs := newFlagSet("list-targets", "")
+	project := fs.String("project", envOr("PROJECT_ID", "CLOUDSDK_CORE_PROJECT"),
+		"project to list, defaults to $PROJECT_ID or $CLOUDSDK_CORE_PROJECT")
+	zone := fs.String("zone", "", "only list instances in this zone")
+	var creds credentialFlags
+	creds.register(fs)
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return &usageError{fmt.Errorf("unexpected argument %q", args[0])}
+	}
+	if *project == "" {
+		return &usageError{errors.New("--project or $PROJECT_ID must be set")}
+	}
+	_, err = creds.proxy.install()
+	if err != nil {
+		return err
+	}
+	ts, err := creds.tokenSource(ctx)
+	if err != nil {
+		return err
+	}
+	targets, err := iaptunnel.ListTargets(ctx, *project, *zone, ts)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tZONE\tSTATUS\tNETWORK_INTERFACES")
+	for _, target := range targets {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", target.Name, target.Zone, target.Status,
+			strings.Join(target.NetworkInterfaces, ","))
+	}
+	return w.Flush()
+}
+
+func printVersion(ctx context.Context, args []string) error {
+	v := version
+	if info, ok := debug.ReadBuildInfo(); ok && v == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		v = info.Main.Version
+	}
+	fmt.Printf("%s %s\n", progName, v)
+	return nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/eahrend/gcp-iap-tunnel-parser/iaptunnel"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	minRestartBackoff = time.Second
+	maxRestartBackoff = time.Minute
+)
+
+// config is the file read by start-tunnels. Project, zone and
+// network interface are the defaults of every tunnel in it.
+type config struct {
+	Project          string `yaml:"project"`
+	Zone             string `yaml:"zone"`
+	NetworkInterface string `yaml:"network_interface"`
+	// CredentialFile and ImpersonateServiceAccount work like the
+	// --credential-file and --impersonate-service-account flags.
+	CredentialFile            string `yaml:"credential_file"`
+	ImpersonateServiceAccount string `yaml:"impersonate_service_account"`
+	// MTLS, ClientCert, ClientKey, UseDeviceCertificate, RelayURL,
+	// RelayCAFile, ProxyURL, ProxyCAFile, SkipInstanceCheck and
+	// LatencyProbeInterval work like the flags of the same names, for
+	// every tunnel.
+	MTLS                 string        `yaml:"mtls"`
+	ClientCert           string        `yaml:"client_cert"`
+	ClientKey            string        `yaml:"client_key"`
+	UseDeviceCertificate bool          `yaml:"use_device_certificate"`
+	RelayURL             string        `yaml:"relay_url"`
+	RelayCAFile          string        `yaml:"relay_ca_file"`
+	ProxyURL             string        `yaml:"proxy_url"`
+	ProxyCAFile          string        `yaml:"proxy_ca_file"`
+	SkipInstanceCheck    bool          `yaml:"skip_instance_check"`
+	LatencyProbeInterval time.Duration `yaml:"latency_probe_interval"`
+	Tunnels              []tunnelEntry `yaml:"tunnels"`
+
+	// proxy is installed once by startTunnels, for every tunnel
+	proxy *proxySettings
+}
+
+// tunnelEntry is one named tunnel, the fields match the start-tunnel flags.
+type tunnelEntry struct {
+	Name                      string `yaml:"name"`
+	Project                   string `yaml:"project"`
+	Zone                      string `yaml:"zone"`
+	Instance                  string `yaml:"instance"`
+	NetworkInterface          string `yaml:"network_interface"`
+	Port                      int    `yaml:"port"`
+	LocalHostPort             string `yaml:"local_host_port"`
+	AllowNonLoopback          bool   `yaml:"allow_non_loopback"`
+	LocalUnixSocket           string `yaml:"local_unix_socket"`
+	LocalUnixSocketMode       string `yaml:"local_unix_socket_mode"`
+	LocalUnixSocketOwner      string `yaml:"local_unix_socket_owner"`
+	CredentialFile            string `yaml:"credential_file"`
+	ImpersonateServiceAccount string `yaml:"impersonate_service_account"`
+
+	tunnelOpts []iaptunnel.TunnelConnectionOption
+	localOpts  []iaptunnel.LocalConnOption
+}
+
+// loadConfig reads and checks the config file at path, unknown
+// keys are an error so typos don't go unnoticed.
+func loadConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg := &config{
+		Project:     envOr("PROJECT_ID", "CLOUDSDK_CORE_PROJECT"),
+		Zone:        envOr("ZONE", "CLOUDSDK_COMPUTE_ZONE"),
+		ProxyURL:    gcloudProxyURL(),
+		ProxyCAFile: os.Getenv("CLOUDSDK_CORE_CUSTOM_CA_CERTS_FILE"),
+	}
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	err = decoder.Decode(cfg)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(cfg.Tunnels) == 0 {
+		return nil, fmt.Errorf("%s: no tunnels", path)
+	}
+	proxy := proxyFlags{url: cfg.ProxyURL, caFile: cfg.ProxyCAFile}
+	cfg.proxy, err = proxy.parse()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, configError(err))
+	}
+	names := map[string]bool{}
+	for i := range cfg.Tunnels {
+		t := &cfg.Tunnels[i]
+		if t.Name == "" {
+			return nil, fmt.Errorf("%s: tunnel %d has no name", path, i+1)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("%s: tunnel %s is there twice", path, t.Name)
+		}
+		names[t.Name] = true
+		err = t.resolve(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: tunnel %s: %w", path, t.Name, configError(err))
+		}
+	}
+	return cfg, nil
+}
+
+// configError words the settingError of a bad value after its key in
+// the config file, it's not a usage error there.
+func configError(err error) error {
+	var settingErr *settingError
+	if errors.As(err, &settingErr) {
+		return fmt.Errorf("invalid %s: %w", settingErr.key, settingErr.err)
+	}
+	return err
+}
+
+// resolve fills in the defaults from cfg and turns the entry into options.
+func (t *tunnelEntry) resolve(cfg *config) error {
+	target := targetFlags{project: t.Project, zone: t.Zone, nic: t.NetworkInterface}
+	target.credentialFile = t.CredentialFile
+	if target.credentialFile == "" {
+		target.credentialFile = cfg.CredentialFile
+	}
+	target.impersonate = t.ImpersonateServiceAccount
+	if target.impersonate == "" {
+		target.impersonate = cfg.ImpersonateServiceAccount
+	}
+	target.mtls = mtlsFlags{
+		policy:        cfg.MTLS,
+		certFile:      cfg.ClientCert,
+		keyFile:       cfg.ClientKey,
+		useDeviceCert: cfg.UseDeviceCertificate,
+	}
+	target.relayURL = cfg.RelayURL
+	target.relayCAFile = cfg.RelayCAFile
+	target.skipInstanceCheck = cfg.SkipInstanceCheck
+	target.latencyProbeInterval = cfg.LatencyProbeInterval
+	if target.mtls.policy == "" {
+		target.mtls.policy = "auto"
+	}
+	if target.project == "" {
+		target.project = cfg.Project
+	}
+	if target.zone == "" {
+		target.zone = cfg.Zone
+	}
+	if target.nic == "" {
+		target.nic = cfg.NetworkInterface
+	}
+	if target.nic == "" {
+		target.nic = "nic0"
+	}
+	switch {
+	case target.project == "":
+		return errors.New("project must be set")
+	case target.skipInstanceCheck && target.zone == "":
+		return errors.New("zone must be set with skip_instance_check")
+	case t.Instance == "":
+		return errors.New("instance must be set")
+	case t.Port == 0:
+		return errors.New("port must be set")
+	case t.Port < 0 || t.Port > 65535:
+		return fmt.Errorf("invalid port %d", t.Port)
+	}
+	port := strconv.Itoa(t.Port)
+	var err error
+	t.tunnelOpts, err = target.tunnelOptions(context.Background())
+	if err != nil {
+		return err
+	}
+	t.tunnelOpts = append(t.tunnelOpts,
+		iaptunnel.WithInstanceName(t.Instance),
+		iaptunnel.WithPort(port))
+	switch {
+	case t.LocalUnixSocket != "" && t.LocalHostPort != "":
+		return errors.New("only one of local_host_port and local_unix_socket can be set")
+	case t.LocalUnixSocket != "":
+		mode := t.LocalUnixSocketMode
+		if mode == "" {
+			mode = "0600"
+		}
+		t.localOpts, err = unixSocketOptions(t.LocalUnixSocket, mode, t.LocalUnixSocketOwner)
+	case t.LocalHostPort != "":
+		t.localOpts, err = localHostPortOptions(t.LocalHostPort, t.AllowNonLoopback)
+	default:
+		return errors.New("local_host_port or local_unix_socket must be set")
+	}
+	return err
+}
+
+func startTunnels(ctx context.Context, args []string) error {
+	fs := newFlagSet("start-tunnels", "")
+	configPath := fs.String("config", os.Getenv("IAP_TUNNEL_CONFIG"), "`path` of the YAML file listing the tunnels, defaults to $IAP_TUNNEL_CONFIG")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return &usageError{fmt.Errorf("unexpected argument %q", args[0])}
+	}
+	if *configPath == "" {
+		return &usageError{errors.New("--config or $IAP_TUNNEL_CONFIG must be set")}
+	}
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	proxyOpts := cfg.proxy.install()
+	for i := range cfg.Tunnels {
+		cfg.Tunnels[i].tunnelOpts = append(cfg.Tunnels[i].tunnelOpts, proxyOpts...)
+	}
+	var wg sync.WaitGroup
+	for _, t := range cfg.Tunnels {
+		wg.Add(1)
+		go func(t tunnelEntry) {
+			defer wg.Done()
+			t.supervise(ctx, &prefixWriter{prefix: "[" + t.Name + "] ", w: os.Stderr})
+		}(t)
+	}
+	wg.Wait()
+	return nil
+}
+
+// supervise runs the tunnel until ctx is done. When it fails it's
+// restarted with backoff, without touching the other tunnels.
+func (t *tunnelEntry) supervise(ctx context.Context, log io.Writer) {
+	backoff := minRestartBackoff
+	for {
+		started := time.Now()
+		err := t.run(ctx, log)
+		if ctx.Err() != nil {
+			if err != nil {
+				fmt.Fprintln(log, err)
+			}
+			return
+		}
+		// a tunnel that served for a while starts over with a short backoff
+		if time.Since(started) > maxRestartBackoff {
+			backoff = minRestartBackoff
+		}
+		fmt.Fprintf(log, "Tunnel failed, restarting in %v: %v\n", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+	}
+}
+
+func (t *tunnelEntry) run(ctx context.Context, log io.Writer) error {
+	orca, err := iaptunnel.NewOrca(ctx,
+		iaptunnel.WithTunnelConnectionOptions(t.tunnelOpts...),
+		iaptunnel.WithLocalConnOptions(t.localOpts...),
+		iaptunnel.WithLogWriter(log))
+	if err != nil {
+		return err
+	}
+	if t.LocalUnixSocket != "" {
+		fmt.Printf("%s LOCAL_UNIX_SOCKET=%s\n", t.Name, orca.Addr())
+	} else {
+		fmt.Printf("%s LOCAL_HOST_PORT=%s\n", t.Name, orca.Addr())
+	}
+	err = orca.Run(ctx)
+	if err == nil && ctx.Err() == nil {
+		// Run only stops on its own when accepting clients failed
+		err = errors.New("stopped accepting clients")
+	}
+	return err
+}
+
+// prefixWriter starts everything written to w with prefix, Orca
+// writes one line at a time.
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	_, err := p.w.Write(append([]byte(p.prefix), b...))
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
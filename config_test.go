@@ -0,0 +1,331 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a config file with content and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tunnels.yaml")
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// clearEnv unsets what loadConfig takes defaults from.
+func clearEnv(t *testing.T) {
+	for _, name := range []string{
+		"PROJECT_ID", "CLOUDSDK_CORE_PROJECT", "ZONE", "CLOUDSDK_COMPUTE_ZONE",
+		"CLOUDSDK_PROXY_ADDRESS", "CLOUDSDK_CORE_CUSTOM_CA_CERTS_FILE",
+	} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		config  string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			config: `
+project: my-project
+tunnels:
+  - name: db
+    instance: db-1
+    port: 5432
+    local_host_port: localhost:5432
+  - name: ssh
+    project: other-project
+    zone: us-east1-b
+    instance: bastion
+    port: 22
+    local_unix_socket: /tmp/ssh.sock
+`,
+		},
+		{
+			name: "unknown key",
+			config: `
+project: my-project
+tunnels:
+  - name: db
+    instance: db-1
+    prot: 5432
+    local_host_port: localhost:5432
+`,
+			wantErr: "field prot not found",
+		},
+		{
+			name:    "no tunnels",
+			config:  "project: my-project\n",
+			wantErr: "no tunnels",
+		},
+		{
+			name: "missing name",
+			config: `
+project: my-project
+tunnels:
+  - instance: db-1
+    port: 5432
+    local_host_port: localhost:5432
+`,
+			wantErr: "tunnel 1 has no name",
+		},
+		{
+			name: "duplicate name",
+			config: `
+project: my-project
+tunnels:
+  - name: db
+    instance: db-1
+    port: 5432
+    local_host_port: localhost:5432
+  - name: db
+    instance: db-2
+    port: 5432
+    local_host_port: localhost:5433
+`,
+			wantErr: "tunnel db is there twice",
+		},
+		{
+			name: "no project",
+			config: `
+tunnels:
+  - name: db
+    instance: db-1
+    port: 5432
+    local_host_port: localhost:5432
+`,
+			wantErr: "project must be set",
+		},
+		{
+			name: "project from the environment",
+			env:  map[string]string{"PROJECT_ID": "my-project"},
+			config: `
+tunnels:
+  - name: db
+    instance: db-1
+    port: 5432
+    local_host_port: localhost:5432
+`,
+		},
+		{
+			name: "credential file inherited",
+			config: `
+project: my-project
+credential_file: /nonexistent/key.json
+tunnels:
+  - name: db
+    instance: db-1
+    port: 5432
+    local_host_port: localhost:5432
+`,
+			wantErr: "/nonexistent/key.json",
+		},
+		{
+			name: "no port",
+			config: `
+project: my-project
+tunnels:
+  - name: db
+    instance: db-1
+    local_host_port: localhost:5432
+`,
+			wantErr: "port must be set",
+		},
+		{
+			name: "invalid port",
+			config: `
+project: my-project
+tunnels:
+  - name: db
+    instance: db-1
+    port: 70000
+    local_host_port: localhost:5432
+`,
+			wantErr: "invalid port 70000",
+		},
+		{
+			name: "both local sides",
+			config: `
+project: my-project
+tunnels:
+  - name: db
+    instance: db-1
+    port: 5432
+    local_host_port: localhost:5432
+    local_unix_socket: /tmp/db.sock
+`,
+			wantErr: "only one of local_host_port and local_unix_socket",
+		},
+		{
+			name: "bad local_host_port",
+			config: `
+project: my-project
+tunnels:
+  - name: db
+    instance: db-1
+    port: 5432
+    local_host_port: localhost
+`,
+			wantErr: "tunnel db: invalid local_host_port",
+		},
+		{
+			name: "bad local_unix_socket_mode",
+			config: `
+project: my-project
+tunnels:
+  - name: db
+    instance: db-1
+    port: 5432
+    local_unix_socket: /tmp/db.sock
+    local_unix_socket_mode: "999"
+`,
+			wantErr: "tunnel db: invalid local_unix_socket_mode",
+		},
+		{
+			name: "bad local_unix_socket_owner",
+			config: `
+project: my-project
+tunnels:
+  - name: db
+    instance: db-1
+    port: 5432
+    local_unix_socket: /tmp/db.sock
+    local_unix_socket_owner: no-such-user-here
+`,
+			wantErr: "tunnel db: invalid local_unix_socket_owner",
+		},
+		{
+			name: "bad mtls",
+			config: `
+project: my-project
+mtls: sometimes
+tunnels:
+  - name: db
+    instance: db-1
+    port: 5432
+    local_host_port: localhost:5432
+`,
+			wantErr: "tunnel db: invalid mtls",
+		},
+		{
+			name: "bad proxy_url",
+			config: `
+project: my-project
+proxy_url: socks5://proxy:1080
+tunnels:
+  - name: db
+    instance: db-1
+    port: 5432
+    local_host_port: localhost:5432
+`,
+			wantErr: "invalid proxy_url",
+		},
+		{
+			name: "bad impersonate_service_account",
+			config: `
+project: my-project
+tunnels:
+  - name: db
+    instance: db-1
+    port: 5432
+    local_host_port: localhost:5432
+    impersonate_service_account: a@p.iam.gserviceaccount.com,
+`,
+			wantErr: "tunnel db: invalid impersonate_service_account",
+		},
+		{
+			name: "skip_instance_check without a zone",
+			config: `
+project: my-project
+skip_instance_check: true
+tunnels:
+  - name: db
+    instance: db-1
+    port: 5432
+    local_host_port: localhost:5432
+`,
+			wantErr: "tunnel db: zone must be set with skip_instance_check",
+		},
+		{
+			name: "no local side",
+			config: `
+project: my-project
+tunnels:
+  - name: db
+    instance: db-1
+    port: 5432
+`,
+			wantErr: "local_host_port or local_unix_socket must be set",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			cfg, err := loadConfig(writeConfig(t, tt.config))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(cfg.Tunnels) == 0 || len(cfg.Tunnels[0].tunnelOpts) == 0 || len(cfg.Tunnels[0].localOpts) == 0 {
+					t.Error("tunnels weren't turned into options")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadConfig = %v, want an error containing %q", err, tt.wantErr)
+			}
+			// the file's mistakes aren't the command line's
+			var usageErr *usageError
+			var settingErr *settingError
+			if errors.As(err, &usageErr) || errors.As(err, &settingErr) || strings.Contains(err.Error(), "--") {
+				t.Errorf("loadConfig = %v, worded as a command line mistake", err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigProxy(t *testing.T) {
+	clearEnv(t)
+	transport := http.DefaultTransport.(*http.Transport)
+	before := reflect.ValueOf(transport.Proxy).Pointer()
+	cfg, err := loadConfig(writeConfig(t, `
+project: my-project
+proxy_url: http://proxy.example.com:3128
+tunnels:
+  - name: db
+    instance: db-1
+    port: 5432
+    local_host_port: localhost:5432
+  - name: ssh
+    instance: bastion
+    port: 22
+    local_host_port: localhost:2222
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.proxy.url == nil || cfg.proxy.url.Host != "proxy.example.com:3128" {
+		t.Errorf("proxy %v, want the proxy_url", cfg.proxy.url)
+	}
+	// startTunnels installs it once, loading leaves the process alone
+	if reflect.ValueOf(transport.Proxy).Pointer() != before {
+		t.Error("loading the config installed the proxy")
+	}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/eahrend/gcp-iap-tunnel-parser/iaptunnel"
+	"golang.org/x/oauth2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// usageError is a mistake in the command line rather than something
+// that failed while running.
+type usageError struct {
+	err error
+}
+
+func (e *usageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *usageError) Unwrap() error {
+	return e.err
+}
+
+// settingError is a bad value of a setting, which is a flag on the
+// command line and key in the config file. On the command line it's a
+// usage error, the config file reports it with configError.
+type settingError struct {
+	flag string
+	key  string
+	err  error
+}
+
+func (e *settingError) Error() string {
+	return fmt.Sprintf("invalid --%s: %v", e.flag, e.err)
+}
+
+func (e *settingError) Unwrap() error {
+	return e.err
+}
+
+// newFlagSet creates the flag set of a subcommand, args describes its
+// positional arguments in the usage line.
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags] %s\n\nFlags:\n", progName, name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses the flags wherever they are in args the way gcloud
+// does, the flag package alone stops at the first positional argument.
+// It returns the positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		err := fs.Parse(args)
+		if err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
+			}
+			return nil, &usageError{err}
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// envOr returns the first of the environment variables that is set.
+func envOr(keys ...string) string {
+	for _, key := range keys {
+		if value := os.Getenv(key); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// credentialFlags pick the credentials to use instead of the
+// application default ones.
+type credentialFlags struct {
+	credentialFile string
+	gcloudAccount  string
+	useGcloud      bool
+	impersonate    string
+	proxy          proxyFlags
+}
+
+func (f *credentialFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.credentialFile, "credential-file", os.Getenv("CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE"),
+		"service account key or workload identity federation config to authenticate with")
+	fs.BoolVar(&f.useGcloud, "use-gcloud-credentials", false, "authenticate as gcloud's active account")
+	fs.StringVar(&f.gcloudAccount, "account", "", "authenticate as this account logged in to gcloud")
+	fs.StringVar(&f.impersonate, "impersonate-service-account", os.Getenv("CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT"),
+		"service account to impersonate, a comma separated list is a delegation chain ending in it")
+	f.proxy.register(fs)
+}
+
+// tokenSource returns the credentials the flags ask for, nil for the
+// application default ones.
+func (f *credentialFlags) tokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	if f.credentialFile != "" && (f.useGcloud || f.gcloudAccount != "") {
+		return nil, &usageError{errors.New("--credential-file can't be used with gcloud credentials")}
+	}
+	var serviceAccount string
+	var delegates []string
+	if f.impersonate != "" {
+		var err error
+		serviceAccount, delegates, err = splitDelegationChain(f.impersonate)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var ts oauth2.TokenSource
+	var err error
+	switch {
+	case f.credentialFile != "":
+		ts, err = iaptunnel.CredentialsFileTokenSource(ctx, f.credentialFile)
+	case f.useGcloud || f.gcloudAccount != "":
+		ts, err = iaptunnel.GcloudUserTokenSource(ctx, f.gcloudAccount)
+	}
+	if err != nil || f.impersonate == "" {
+		return ts, err
+	}
+	if ts == nil {
+		ts, err = iaptunnel.DefaultTokenSource(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return iaptunnel.ImpersonatedTokenSource(ctx, ts, serviceAccount, delegates...)
+}
+
+// splitDelegationChain splits the --impersonate-service-account list
+// into the service account at its end and the delegates leading to it.
+func splitDelegationChain(impersonate string) (string, []string, error) {
+	chain := strings.Split(impersonate, ",")
+	for i := range chain {
+		chain[i] = strings.TrimSpace(chain[i])
+		if chain[i] == "" {
+			return "", nil, &settingError{"impersonate-service-account", "impersonate_service_account",
+				fmt.Errorf("%q has an empty service account", impersonate)}
+		}
+	}
+	return chain[len(chain)-1], chain[:len(chain)-1], nil
+}
+
+// targetFlags are the flags naming where an instance lives and how to
+// authenticate, shared by the subcommands that open tunnels.
+type targetFlags struct {
+	credentialFlags
+	project string
+	zone    string
+	nic     string
+	// skipInstanceCheck is for accounts without compute.instances.list
+	skipInstanceCheck bool
+	mtls              mtlsFlags
+	// relayURL and relayCAFile are for reaching IAP through a private
+	// endpoint or a proxy that intercepts TLS.
+	relayURL    string
+	relayCAFile string
+	// latencyProbeInterval turns on latency probes when it's above 0
+	latencyProbeInterval time.Duration
+}
+
+func (f *targetFlags) register(fs *flag.FlagSet) {
+	f.credentialFlags.register(fs)
+	fs.StringVar(&f.project, "project", envOr("PROJECT_ID", "CLOUDSDK_CORE_PROJECT"),
+		"project of the instance, defaults to $PROJECT_ID or $CLOUDSDK_CORE_PROJECT")
+	fs.StringVar(&f.zone, "zone", envOr("ZONE", "CLOUDSDK_COMPUTE_ZONE"),
+		"zone of the instance, defaults to $ZONE or $CLOUDSDK_COMPUTE_ZONE, looked up by the instance name when not set")
+	fs.StringVar(&f.nic, "network-interface", "nic0", "network interface of the instance to connect to")
+	fs.BoolVar(&f.skipInstanceCheck, "skip-instance-check", false,
+		"don't check the instance is running and has the network interface, which needs compute.instances.list, --zone has to be given with it")
+	f.mtls.register(fs)
+	fs.StringVar(&f.relayURL, "relay-url", "", "base `URL` of the tunnel relay instead of wss://tunnel.cloudproxy.app")
+	fs.StringVar(&f.relayCAFile, "relay-ca-file", "", "PEM `file` of CA certificates to trust for the relay on top of the system ones")
+	fs.DurationVar(&f.latencyProbeInterval, "latency-probe-interval", 0,
+		"measure the latency to IAP every `interval` and log it per client, off when 0")
+}
+
+func (f *targetFlags) validate() error {
+	if f.project == "" {
+		return &usageError{errors.New("--project or $PROJECT_ID must be set")}
+	}
+	if f.skipInstanceCheck && f.zone == "" {
+		return &usageError{errors.New("--zone or $ZONE must be set with --skip-instance-check")}
+	}
+	return nil
+}
+
+func (f *targetFlags) options(ctx context.Context) ([]iaptunnel.TunnelConnectionOption, error) {
+	proxyOpts, err := f.proxy.install()
+	if err != nil {
+		return nil, err
+	}
+	opts, err := f.tunnelOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(opts, proxyOpts...), nil
+}
+
+// tunnelOptions turns everything but the proxy into options, the config
+// file installs its proxy once for every tunnel.
+func (f *targetFlags) tunnelOptions(ctx context.Context) ([]iaptunnel.TunnelConnectionOption, error) {
+	opts := []iaptunnel.TunnelConnectionOption{
+		iaptunnel.WithProject(f.project),
+		iaptunnel.WithZone(f.zone),
+		iaptunnel.WithNic(f.nic),
+		iaptunnel.WithSkipInstanceCheck(f.skipInstanceCheck),
+	}
+	ts, err := f.tokenSource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ts != nil {
+		opts = append(opts, iaptunnel.WithTokenSource(ts))
+	}
+	if f.relayURL != "" {
+		opts = append(opts, iaptunnel.WithBaseURL(f.relayURL))
+	}
+	if f.relayCAFile != "" {
+		roots, err := loadCertPool(f.relayCAFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, iaptunnel.WithTLSConfig(&tls.Config{RootCAs: roots}))
+	}
+	if f.latencyProbeInterval > 0 {
+		opts = append(opts, iaptunnel.WithLatencyProbeInterval(f.latencyProbeInterval))
+	}
+	mtlsOpts, err := f.mtls.options()
+	if err != nil {
+		return nil, err
+	}
+	return append(opts, mtlsOpts...), nil
+}
+
+// loadCertPool returns the system roots plus the certificates in the
+// PEM file at path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s has no PEM certificates", path)
+	}
+	return roots, nil
+}
+
+// proxyFlags pick the HTTP proxy to go through instead of the one in
+// $HTTPS_PROXY, defaulting to gcloud's proxy settings.
+type proxyFlags struct {
+	url    string
+	caFile string
+}
+
+func (f *proxyFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.url, "proxy-url", gcloudProxyURL(),
+		"http or https `URL` of the proxy to go through, user info is sent as basic auth, defaults to $CLOUDSDK_PROXY_*")
+	fs.StringVar(&f.caFile, "proxy-ca-file", os.Getenv("CLOUDSDK_CORE_CUSTOM_CA_CERTS_FILE"),
+		"PEM `file` of CA certificates to trust for the proxy on top of the system ones, defaults to $CLOUDSDK_CORE_CUSTOM_CA_CERTS_FILE")
+}
+
+// gcloudProxyURL puts together the proxy URL from the variables gcloud
+// reads its proxy settings from, empty when there is none.
+func gcloudProxyURL() string {
+	address := os.Getenv("CLOUDSDK_PROXY_ADDRESS")
+	if address == "" {
+		return ""
+	}
+	proxyType := os.Getenv("CLOUDSDK_PROXY_TYPE")
+	if proxyType == "" {
+		proxyType = "http"
+	}
+	u := &url.URL{Scheme: proxyType, Host: address}
+	if port := os.Getenv("CLOUDSDK_PROXY_PORT"); port != "" {
+		u.Host = net.JoinHostPort(address, port)
+	}
+	if username := os.Getenv("CLOUDSDK_PROXY_USERNAME"); username != "" {
+		u.User = url.UserPassword(username, os.Getenv("CLOUDSDK_PROXY_PASSWORD"))
+	}
+	return u.String()
+}
+
+// proxySettings are the checked proxy flags, either can be nil.
+type proxySettings struct {
+	url   *url.URL
+	roots *x509.CertPool
+}
+
+// parse checks the proxy URL and loads the CA file.
+func (f *proxyFlags) parse() (*proxySettings, error) {
+	p := &proxySettings{}
+	if f.url != "" {
+		proxyURL, err := url.Parse(f.url)
+		if err != nil {
+			return nil, &settingError{"proxy-url", "proxy_url", err}
+		}
+		if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" {
+			return nil, &settingError{"proxy-url", "proxy_url", fmt.Errorf("%s proxies aren't supported, only http and https ones", proxyURL.Scheme)}
+		}
+		if proxyURL.Host == "" {
+			return nil, &settingError{"proxy-url", "proxy_url", fmt.Errorf("%q has no host", f.url)}
+		}
+		p.url = proxyURL
+	}
+	if f.caFile != "" {
+		roots, err := loadCertPool(f.caFile)
+		if err != nil {
+			return nil, err
+		}
+		p.roots = roots
+	}
+	return p, nil
+}
+
+// install is parse followed by installing the settings.
+func (f *proxyFlags) install() ([]iaptunnel.TunnelConnectionOption, error) {
+	p, err := f.parse()
+	if err != nil {
+		return nil, err
+	}
+	return p.install(), nil
+}
+
+// install sends the API calls of the whole process through the proxy
+// and returns the tunnel options for it, so the websocket goes the same
+// way.
+func (p *proxySettings) install() []iaptunnel.TunnelConnectionOption {
+	var opts []iaptunnel.TunnelConnectionOption
+	transport := http.DefaultTransport.(*http.Transport)
+	if p.url != nil {
+		transport.Proxy = http.ProxyURL(p.url)
+		opts = append(opts, iaptunnel.WithProxyURL(p.url))
+	}
+	if p.roots != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: p.roots}
+		opts = append(opts, iaptunnel.WithProxyTLSConfig(&tls.Config{RootCAs: p.roots}))
+	}
+	return opts
+}
+
+// mtlsFlags pick the client certificate for the mTLS endpoint, which
+// access levels requiring a trusted device need.
+type mtlsFlags struct {
+	policy        string
+	certFile      string
+	keyFile       string
+	useDeviceCert bool
+}
+
+func (f *mtlsFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.policy, "mtls", "auto",
+		"when to use the mTLS endpoint: never, auto when a client certificate is available or always")
+	fs.StringVar(&f.certFile, "client-cert", "", "PEM `file` with the client certificate chain for mTLS")
+	fs.StringVar(&f.keyFile, "client-key", "", "PEM `file` with the key of --client-cert")
+	fs.BoolVar(&f.useDeviceCert, "use-device-certificate", os.Getenv("GOOGLE_API_USE_CLIENT_CERTIFICATE") == "true",
+		"use the Endpoint Verification device certificate for mTLS, defaults to $GOOGLE_API_USE_CLIENT_CERTIFICATE")
+}
+
+// options turns the flags into tunnel options. A certificate that fails
+// to load is an error with --mtls always, auto goes on without it.
+func (f *mtlsFlags) options() ([]iaptunnel.TunnelConnectionOption, error) {
+	policy, err := iaptunnel.ParseMTLSPolicy(f.policy)
+	if err != nil {
+		return nil, &settingError{"mtls", "mtls", err}
+	}
+	opts := []iaptunnel.TunnelConnectionOption{iaptunnel.WithMTLSPolicy(policy)}
+	switch {
+	case (f.certFile == "") != (f.keyFile == ""):
+		return nil, &settingError{"client-key", "client_key", errors.New("has to be given together with the client certificate")}
+	case f.certFile != "" && f.useDeviceCert:
+		return nil, &settingError{"client-cert", "client_cert", errors.New("can't be used together with the device certificate")}
+	case f.certFile != "":
+		source, err := iaptunnel.PEMCertificateSource(f.certFile, f.keyFile)
+		if err != nil {
+			if policy == iaptunnel.MTLSAlways {
+				return nil, fmt.Errorf("loading client certificate: %w", err)
+			}
+			fmt.Fprintf(os.Stderr, "Not using mTLS, loading client certificate failed: %v\n", err)
+			return opts, nil
+		}
+		opts = append(opts, iaptunnel.WithClientCertificateSource(source))
+	case f.useDeviceCert:
+		opts = append(opts, iaptunnel.WithClientCertificateSource(iaptunnel.SecureConnectCertificateSource()))
+	}
+	return opts, nil
+}
+
+// instancePort reads the INSTANCE PORT arguments, falling back to the
+// $INSTANCE and $PORT environment variables.
+func instancePort(args []string) (string, string, error) {
+	instance, port := os.Getenv("INSTANCE"), os.Getenv("PORT")
+	switch len(args) {
+	case 0:
+	case 2:
+		instance, port = args[0], args[1]
+	default:
+		return "", "", &usageError{fmt.Errorf("expected INSTANCE PORT, got %d arguments", len(args))}
+	}
+	if instance == "" || port == "" {
+		return "", "", &usageError{errors.New("INSTANCE and PORT must be given")}
+	}
+	err := checkPort(port, false)
+	if err != nil {
+		return "", "", err
+	}
+	return instance, port, nil
+}
+
+// checkPort makes sure port is a port number, 0 only if allowZero.
+func checkPort(port string, allowZero bool) error {
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (n == 0 && !allowZero) {
+		return &usageError{fmt.Errorf("invalid port %q", port)}
+	}
+	return nil
+}
+
+// splitLocalHostPort splits the --local-host-port value, the host has
+// to be localhost or an IP address, IPv6 ones in brackets.
+func splitLocalHostPort(hostPort string) (string, string, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", "", &settingError{"local-host-port", "local_host_port", err}
+	}
+	if host != "" && host != "localhost" && net.ParseIP(host) == nil {
+		return "", "", &settingError{"local-host-port", "local_host_port", fmt.Errorf("%q is not localhost or an IP address", host)}
+	}
+	if checkPort(port, true) != nil {
+		return "", "", &settingError{"local-host-port", "local_host_port", fmt.Errorf("invalid port %q", port)}
+	}
+	return host, port, nil
+}
+
+func localHostPortOptions(hostPort string, allowNonLoopback bool) ([]iaptunnel.LocalConnOption, error) {
+	host, port, err := splitLocalHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	return []iaptunnel.LocalConnOption{
+		iaptunnel.WithLocalConnHost(host),
+		iaptunnel.WithLocalConnPort(port),
+		iaptunnel.WithLocalConnAllowNonLoopback(allowNonLoopback),
+	}, nil
+}
+
+func unixSocketOptions(path, mode, owner string) ([]iaptunnel.LocalConnOption, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0777 {
+		return nil, &settingError{"local-unix-socket-mode", "local_unix_socket_mode", fmt.Errorf("%q is not an octal mode", mode)}
+	}
+	opts := []iaptunnel.LocalConnOption{iaptunnel.WithLocalConnUnixSocket(path, os.FileMode(perm))}
+	if owner != "" {
+		uid, gid, err := lookupOwner(owner)
+		if err != nil {
+			return nil, &settingError{"local-unix-socket-owner", "local_unix_socket_owner", err}
+		}
+		opts = append(opts, iaptunnel.WithLocalConnUnixSocketOwner(uid, gid))
+	}
+	return opts, nil
+}
+
+// lookupOwner resolves user[:group] to ids, the group is -1 when it's
+// left out.
+func lookupOwner(owner string) (int, int, error) {
+	userName, groupName, hasGroup := strings.Cut(owner, ":")
+	u, err := user.Lookup(userName)
+	if err != nil {
+		u, err = user.LookupId(userName)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("user %s has no numeric id", userName)
+	}
+	if !hasGroup {
+		return uid, -1, nil
+	}
+	g, err := user.LookupGroup(groupName)
+	if err != nil {
+		g, err = user.LookupGroupId(groupName)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("group %s has no numeric id", groupName)
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSplitDelegationChain(t *testing.T) {
+	tests := []struct {
+		impersonate    string
+		serviceAccount string
+		delegates      []string
+		wantErr        bool
+	}{
+		{"target@p.iam.gserviceaccount.com", "target@p.iam.gserviceaccount.com", []string{}, false},
+		{"a@p.iam.gserviceaccount.com,target@p.iam.gserviceaccount.com",
+			"target@p.iam.gserviceaccount.com", []string{"a@p.iam.gserviceaccount.com"}, false},
+		{"a@p.iam.gserviceaccount.com, b@p.iam.gserviceaccount.com, target@p.iam.gserviceaccount.com",
+			"target@p.iam.gserviceaccount.com", []string{"a@p.iam.gserviceaccount.com", "b@p.iam.gserviceaccount.com"}, false},
+		{"a@p.iam.gserviceaccount.com,", "", nil, true},
+		{",target@p.iam.gserviceaccount.com", "", nil, true},
+	}
+	for _, tt := range tests {
+		serviceAccount, delegates, err := splitDelegationChain(tt.impersonate)
+		if tt.wantErr {
+			var settingErr *settingError
+			if !errors.As(err, &settingErr) {
+				t.Errorf("splitDelegationChain(%q) = %v, want a settingError", tt.impersonate, err)
+			}
+			continue
+		}
+		if err != nil || serviceAccount != tt.serviceAccount || !reflect.DeepEqual(delegates, tt.delegates) {
+			t.Errorf("splitDelegationChain(%q) = %q, %q, %v, want %q, %q",
+				tt.impersonate, serviceAccount, delegates, err, tt.serviceAccount, tt.delegates)
+		}
+	}
+}
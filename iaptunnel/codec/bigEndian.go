@@ -0,0 +1,71 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// every binary struct pack that google does seems to be in big endian
+
+// ErrShortBuffer is returned when a field doesn't fit in the buffer
+// at the given offset.
+var ErrShortBuffer = errors.New("buffer too short")
+
+func checkBounds(data []byte, offset int, size int) error {
+	if offset < 0 || len(data) < offset+size {
+		return fmt.Errorf("%w: need %d bytes at offset %d, have %d", ErrShortBuffer, size, offset, len(data))
+	}
+	return nil
+}
+
+func decodeUint16(data []byte, offset int) (uint16, error) {
+	err := checkBounds(data, offset, 2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(data[offset:]), nil
+}
+
+func encodeUint16(value uint16, data []byte, offset int) ([]byte, error) {
+	err := checkBounds(data, offset, 2)
+	if err != nil {
+		return data, err
+	}
+	binary.BigEndian.PutUint16(data[offset:], value)
+	return data, nil
+}
+
+func decodeUint32(data []byte, offset int) (uint32, error) {
+	err := checkBounds(data, offset, 4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(data[offset:]), nil
+}
+
+func encodeUint32(value uint32, data []byte, offset int) ([]byte, error) {
+	err := checkBounds(data, offset, 4)
+	if err != nil {
+		return data, err
+	}
+	binary.BigEndian.PutUint32(data[offset:], value)
+	return data, nil
+}
+
+func decodeUint64(data []byte, offset int) (uint64, error) {
+	err := checkBounds(data, offset, 8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(data[offset:]), nil
+}
+
+func encodeUint64(value uint64, data []byte, offset int) ([]byte, error) {
+	err := checkBounds(data, offset, 8)
+	if err != nil {
+		return data, err
+	}
+	binary.BigEndian.PutUint64(data[offset:], value)
+	return data, nil
+}
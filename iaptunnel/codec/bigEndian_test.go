@@ -0,0 +1,111 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"testing/quick"
+)
+
+func TestUint16RoundTrip(t *testing.T) {
+	f := func(value uint16, pad uint8) bool {
+		offset := int(pad % 8)
+		data, err := encodeUint16(value, make([]byte, offset+2), offset)
+		if err != nil {
+			return false
+		}
+		got, err := decodeUint16(data, offset)
+		return err == nil && got == value && binary.BigEndian.Uint16(data[offset:]) == value
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUint32RoundTrip(t *testing.T) {
+	f := func(value uint32, pad uint8) bool {
+		offset := int(pad % 8)
+		data, err := encodeUint32(value, make([]byte, offset+4), offset)
+		if err != nil {
+			return false
+		}
+		got, err := decodeUint32(data, offset)
+		return err == nil && got == value && binary.BigEndian.Uint32(data[offset:]) == value
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUint64RoundTrip(t *testing.T) {
+	f := func(value uint64, pad uint8) bool {
+		offset := int(pad % 8)
+		data, err := encodeUint64(value, make([]byte, offset+8), offset)
+		if err != nil {
+			return false
+		}
+		got, err := decodeUint64(data, offset)
+		return err == nil && got == value && binary.BigEndian.Uint64(data[offset:]) == value
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecodeHighBytes(t *testing.T) {
+	data := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	if got, _ := decodeUint16(data, 0); got != 0x0102 {
+		t.Errorf("decodeUint16 = %#x", got)
+	}
+	if got, _ := decodeUint32(data, 0); got != 0x01020304 {
+		t.Errorf("decodeUint32 = %#x", got)
+	}
+	if got, _ := decodeUint64(data, 0); got != 0x0102030405060708 {
+		t.Errorf("decodeUint64 = %#x", got)
+	}
+}
+
+func TestShortBuffer(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		offset int
+	}{
+		{"empty", nil, 0},
+		{"short", []byte{1}, 0},
+		{"offset past end", make([]byte, 8), 7},
+		{"negative offset", make([]byte, 8), -1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := decodeUint16(tc.data, tc.offset); !errors.Is(err, ErrShortBuffer) {
+				t.Errorf("decodeUint16 error = %v", err)
+			}
+			if _, err := decodeUint32(tc.data, tc.offset); !errors.Is(err, ErrShortBuffer) {
+				t.Errorf("decodeUint32 error = %v", err)
+			}
+			if _, err := decodeUint64(tc.data, tc.offset); !errors.Is(err, ErrShortBuffer) {
+				t.Errorf("decodeUint64 error = %v", err)
+			}
+			if _, err := encodeUint64(1, tc.data, tc.offset); !errors.Is(err, ErrShortBuffer) {
+				t.Errorf("encodeUint64 error = %v", err)
+			}
+		})
+	}
+}
+
+func FuzzDecodeUint(f *testing.F) {
+	f.Add([]byte{}, 0)
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 0)
+	f.Add([]byte{0, 1, 2}, 2)
+	f.Fuzz(func(t *testing.T, data []byte, offset int) {
+		if v, err := decodeUint16(data, offset); err == nil && v != binary.BigEndian.Uint16(data[offset:]) {
+			t.Errorf("decodeUint16 = %d", v)
+		}
+		if v, err := decodeUint32(data, offset); err == nil && v != binary.BigEndian.Uint32(data[offset:]) {
+			t.Errorf("decodeUint32 = %d", v)
+		}
+		if v, err := decodeUint64(data, offset); err == nil && v != binary.BigEndian.Uint64(data[offset:]) {
+			t.Errorf("decodeUint64 = %d", v)
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrUnknownTag is returned for frames with a tag the decoder doesn't know
+	// the layout of, there's no way to find where the next frame starts.
+	ErrUnknownTag = errors.New("unknown message tag")
+	// ErrFrameLength is returned when the length a frame declares is out of
+	// range or doesn't match the frame.
+	ErrFrameLength = errors.New("invalid frame length")
+)
+
+const (
+	tagLength          = 2
+	lengthFieldLength  = 4
+	ackFrameLength     = tagLength + 8
+	maxDataFrameLength = 65535
+)
+
+// Decoder reassembles subprotocol frames out of websocket messages, one
+// message can hold several frames and one frame can span messages.
+type Decoder struct {
+	buf []byte
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{}
+}
+
+// Write queues a websocket message to be split into frames by Next.
+func (d *Decoder) Write(p []byte) (int, error) {
+	d.buf = append(d.buf, p...)
+	return len(p), nil
+}
+
+// Next returns the next complete frame, or nil if more data is needed.
+func (d *Decoder) Next() ([]byte, error) {
+	n, err := FrameLength(d.buf)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || len(d.buf) < n {
+		return nil, nil
+	}
+	frame := make([]byte, n)
+	copy(frame, d.buf)
+	d.buf = d.buf[n:]
+	if len(d.buf) == 0 {
+		d.buf = nil
+	}
+	return frame, nil
+}
+
+// NextFrame is Next followed by DecodeFrame, it returns nil if more
+// data is needed.
+func (d *Decoder) NextFrame() (Frame, error) {
+	data, err := d.Next()
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return DecodeFrame(data)
+}
+
+// Reset drops any partial frame, used when the websocket is replaced.
+func (d *Decoder) Reset() {
+	d.buf = nil
+}
+
+// FrameLength returns the total length of the frame data starts with, or
+// zero if there isn't enough of it yet to tell.
+func FrameLength(data []byte) (int, error) {
+	tag, rest, err := ExtractSubProtocolTag(data)
+	if err != nil {
+		return 0, nil
+	}
+	switch MessageTag(tag) {
+	case MessageConnectSuccessSid, MessageData:
+		length, _, err := ExtractUnsignedInt32(rest)
+		if err != nil {
+			return 0, nil
+		}
+		if length > maxDataFrameLength-tagLength-lengthFieldLength {
+			return 0, fmt.Errorf("%w: %d bytes", ErrFrameLength, length)
+		}
+		return tagLength + lengthFieldLength + int(length), nil
+	case MessageReconnectSuccessAck, MessageAck, MessageAckLatency, MessageReplyLatency:
+		return ackFrameLength, nil
+	}
+	return 0, fmt.Errorf("%w: %d", ErrUnknownTag, tag)
+}
@@ -0,0 +1,151 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTruncatedFrame is returned when data ends before the frame does.
+var ErrTruncatedFrame = errors.New("truncated frame")
+
+// Frame is a decoded subprotocol frame, callers switch on the concrete type.
+type Frame interface {
+	Tag() MessageTag
+	// Encode returns the frame as it's sent over the websocket
+	Encode() []byte
+}
+
+// ConnectSuccessSidFrame is the first frame of a new tunnel, the SID
+// is needed to reconnect it.
+type ConnectSuccessSidFrame struct {
+	SID string
+}
+
+// ReconnectSuccessAckFrame is the first frame after a reconnect, Ack is
+// how many bytes IAP got before the websocket dropped.
+type ReconnectSuccessAckFrame struct {
+	Ack uint64
+}
+
+// DataFrame carries payload bytes.
+type DataFrame struct {
+	Data []byte
+}
+
+// AckFrame is the total number of payload bytes received.
+type AckFrame struct {
+	Ack uint64
+}
+
+// AckLatencyFrame and ReplyLatencyFrame are laid out like ack frames,
+// the uint64 is a timestamp.
+type AckLatencyFrame struct {
+	Timestamp uint64
+}
+
+type ReplyLatencyFrame struct {
+	Timestamp uint64
+}
+
+// DecodeFrame decodes exactly one frame, ErrTruncatedFrame means more data
+// is needed and ErrUnknownTag that the frame can't be decoded at all.
+func DecodeFrame(data []byte) (Frame, error) {
+	n, err := FrameLength(data)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || len(data) < n {
+		return nil, fmt.Errorf("%w: have %d bytes", ErrTruncatedFrame, len(data))
+	}
+	if len(data) > n {
+		return nil, fmt.Errorf("%w: %d bytes after the frame", ErrFrameLength, len(data)-n)
+	}
+	msg := NewIAPMessage(data)
+	switch tag := msg.PeekMessageTag(); tag {
+	case MessageConnectSuccessSid:
+		sid, err := msg.AsConnectSIDMessage().GetSID()
+		if err != nil {
+			return nil, err
+		}
+		return &ConnectSuccessSidFrame{SID: sid}, nil
+	case MessageData:
+		payload, err := msg.AsDataMessage().GetData()
+		if err != nil {
+			return nil, err
+		}
+		return &DataFrame{Data: payload}, nil
+	default:
+		value, err := NewIAPAckMessage(data).GetAck()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case MessageReconnectSuccessAck:
+			return &ReconnectSuccessAckFrame{Ack: value}, nil
+		case MessageAck:
+			return &AckFrame{Ack: value}, nil
+		case MessageAckLatency:
+			return &AckLatencyFrame{Timestamp: value}, nil
+		case MessageReplyLatency:
+			return &ReplyLatencyFrame{Timestamp: value}, nil
+		}
+		return nil, fmt.Errorf("%w: %d", ErrUnknownTag, tag)
+	}
+}
+
+func (f *ConnectSuccessSidFrame) Tag() MessageTag {
+	return MessageConnectSuccessSid
+}
+
+func (f *ConnectSuccessSidFrame) Encode() []byte {
+	data := CreateSubprotocolDataFrame([]byte(f.SID))
+	data, _ = encodeUint16(uint16(MessageConnectSuccessSid), data, 0)
+	return data
+}
+
+func (f *ReconnectSuccessAckFrame) Tag() MessageTag {
+	return MessageReconnectSuccessAck
+}
+
+func (f *ReconnectSuccessAckFrame) Encode() []byte {
+	return encodeAckLayout(MessageReconnectSuccessAck, f.Ack)
+}
+
+func (f *DataFrame) Tag() MessageTag {
+	return MessageData
+}
+
+func (f *DataFrame) Encode() []byte {
+	return CreateSubprotocolDataFrame(f.Data)
+}
+
+func (f *AckFrame) Tag() MessageTag {
+	return MessageAck
+}
+
+func (f *AckFrame) Encode() []byte {
+	return encodeAckLayout(MessageAck, f.Ack)
+}
+
+func (f *AckLatencyFrame) Tag() MessageTag {
+	return MessageAckLatency
+}
+
+func (f *AckLatencyFrame) Encode() []byte {
+	return encodeAckLayout(MessageAckLatency, f.Timestamp)
+}
+
+func (f *ReplyLatencyFrame) Tag() MessageTag {
+	return MessageReplyLatency
+}
+
+func (f *ReplyLatencyFrame) Encode() []byte {
+	return encodeAckLayout(MessageReplyLatency, f.Timestamp)
+}
+
+func encodeAckLayout(tag MessageTag, value uint64) []byte {
+	msg := NewIAPAckMessage(nil)
+	msg.SetTag(tag)
+	msg.SetAck(value)
+	return msg.Bytes()
+}
@@ -0,0 +1,73 @@
+package codec
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeFrameRoundTrip(t *testing.T) {
+	for _, want := range []Frame{
+		&ConnectSuccessSidFrame{SID: "a-sid"},
+		&ReconnectSuccessAckFrame{Ack: 1 << 33},
+		&DataFrame{Data: []byte("payload")},
+		&AckFrame{Ack: 42},
+		&AckLatencyFrame{Timestamp: 7},
+		&ReplyLatencyFrame{Timestamp: 8},
+	} {
+		data := want.Encode()
+		if got := NewIAPMessage(data).PeekMessageTag(); got != want.Tag() {
+			t.Errorf("%T encoded with tag %d", want, got)
+		}
+		got, err := DecodeFrame(data)
+		if err != nil {
+			t.Errorf("DecodeFrame(%T): %v", want, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("DecodeFrame = %#v, want %#v", got, want)
+		}
+		_, err = DecodeFrame(data[:len(data)-1])
+		if !errors.Is(err, ErrTruncatedFrame) {
+			t.Errorf("DecodeFrame(truncated %T) error = %v", want, err)
+		}
+	}
+}
+
+func TestDecodeFrameErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, ErrTruncatedFrame},
+		{"unused tag", frame(MessageTagUnused, nil), ErrUnknownTag},
+		{"deprecated tag", frame(MessageDeprecated, make([]byte, 8)), ErrUnknownTag},
+		{"trailing bytes", append((&AckFrame{}).Encode(), 0), ErrFrameLength},
+		{"oversized data", []byte{0, 4, 0xff, 0xff, 0xff, 0xff}, ErrFrameLength},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := DecodeFrame(tc.data)
+			if !errors.Is(err, tc.want) {
+				t.Errorf("error = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func FuzzDecodeFrame(f *testing.F) {
+	addMessageSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		got, err := DecodeFrame(data)
+		if err != nil {
+			return
+		}
+		if NewIAPMessage(data).PeekMessageTag() != got.Tag() {
+			t.Errorf("tag %d decoded as %T", NewIAPMessage(data).PeekMessageTag(), got)
+		}
+		again, err := DecodeFrame(got.Encode())
+		if err != nil || !reflect.DeepEqual(again, got) {
+			t.Errorf("re-decoding %#v = %#v, %v", got, again, err)
+		}
+	})
+}
@@ -1,16 +1,21 @@
-package main
+// Package codec encodes and decodes the frames of the
+// relay.tunnel.cloudproxy.app websocket subprotocol used by IAP.
+package codec
 
 import (
 	"errors"
 	"fmt"
 )
 
+// IAPMessageInterface is implemented by every message type, GetTag
+// returns MessageTagUnused when the frame is too short to hold a tag.
 type IAPMessageInterface interface {
 	GetTag() MessageTag
 	SetTag(MessageTag)
 	GetSequenceNumber() uint64
 	SetSequenceNumber(uint64)
 	ToString() string
+	Bytes() []byte
 }
 
 type IAPMessage struct {
@@ -50,19 +55,28 @@ func (msg *IAPMessage) AsDataMessage() *IAPDataMessage {
 }
 
 func (msg *IAPMessage) PeekMessageTag() MessageTag {
-	return getTag(msg.data, 0)
+	tag, _ := getTag(msg.data, 0)
+	return tag
 }
 
-// GetMessageFromTag probably doesn't work as nicely as I'd like it to.
-// the client calling it will need to figure out what to do.
+// GetMessageFromTag wraps the frame in the message type for its tag, the
+// latency frames share the ack layout. DecodeFrame is easier to work with.
 func (msg *IAPMessage) GetMessageFromTag() (IAPMessageInterface, error) {
 	tag := msg.PeekMessageTag()
-	switch msgTag := tag; {
-	case msgTag == MessageConnectSuccessSid:
-		iapsidmsg := NewIAPSIDMessage(msg.data)
-		return iapsidmsg, nil
+	switch tag {
+	case MessageConnectSuccessSid:
+		return NewIAPSIDMessage(msg.data), nil
+	case MessageData:
+		return NewIAPDataMessage(msg.data), nil
+	case MessageReconnectSuccessAck, MessageAck, MessageAckLatency, MessageReplyLatency:
+		return NewIAPAckMessage(msg.data), nil
 	}
-	return nil, errors.New(fmt.Sprintf("failed to get message tag: %d", tag))
+	return nil, fmt.Errorf("%w: %d", ErrUnknownTag, tag)
+}
+
+// Bytes returns the raw frame backing the message
+func (msg *IAPMessage) Bytes() []byte {
+	return msg.data
 }
 
 func (msg *IAPMessage) ToString() string {
@@ -70,7 +84,8 @@ func (msg *IAPMessage) ToString() string {
 }
 
 func (msg *IAPMessage) GetTag() MessageTag {
-	return getTag(msg.data, 0)
+	tag, _ := getTag(msg.data, 0)
+	return tag
 }
 
 func (msg *IAPMessage) SetTag(tag MessageTag) {
@@ -85,9 +100,9 @@ func (msg *IAPMessage) SetSequenceNumber(sequenceNumber uint64) {
 	msg.sequenceNumber = sequenceNumber
 }
 
-func getTag(data []byte, offset int) MessageTag {
-	tag := decodeUint16(data, offset)
-	return MessageTag(tag)
+func getTag(data []byte, offset int) (MessageTag, error) {
+	tag, err := decodeUint16(data, offset)
+	return MessageTag(tag), err
 }
 
 type IAPDataMessage struct {
@@ -111,7 +126,8 @@ func NewIAPDataMessage(data []byte) *IAPDataMessage {
 }
 
 func (msg *IAPDataMessage) GetTag() MessageTag {
-	return getTag(msg.data, 0)
+	tag, _ := getTag(msg.data, 0)
+	return tag
 }
 func (msg *IAPDataMessage) SetTag(tag MessageTag) {
 	msg.tag = tag
@@ -129,21 +145,45 @@ func (msg *IAPDataMessage) GetExpectedAck() uint64 {
 	return msg.sequenceNumber + uint64(msg.dataLength)
 }
 
-func (msg *IAPDataMessage) GetDataLength() uint32 {
+// GetDataLength returns the payload length the frame header declares.
+func (msg *IAPDataMessage) GetDataLength() (uint32, error) {
 	return decodeUint32(msg.data, 2)
 }
 
+// GetData checks the declared length against the frame and returns the
+// payload without the header.
+func (msg *IAPDataMessage) GetData() ([]byte, error) {
+	length, err := msg.GetDataLength()
+	if err != nil {
+		return nil, err
+	}
+	payload := msg.data[msg.dataOffset:]
+	if length > msg.maxDataLength || int(length) != len(payload) {
+		return nil, fmt.Errorf("%w: declared %d bytes, frame has %d", ErrFrameLength, length, len(payload))
+	}
+	return payload, nil
+}
+
 func (msg *IAPDataMessage) SetDataLength(value uint32) error {
-	if value < 0 || value > msg.maxDataLength {
+	if value > msg.maxDataLength {
 		return errors.New("value out of range")
 	}
-	newData := encodeUint32(value, msg.data, 2)
+	newData, err := encodeUint32(value, msg.data, 2)
+	if err != nil {
+		return err
+	}
 	msg.data = newData
 	return nil
 }
 
+// CreateDataFrame wraps the payload in a data frame header, after which
+// GetExpectedAck is the ack IAP sends once it has the frame.
 func (msg *IAPDataMessage) CreateDataFrame() error {
-	msg.data = createSubprotocolDataFrame(msg.data)
+	if uint32(len(msg.data)) > msg.maxDataLength {
+		return errors.New("value out of range")
+	}
+	msg.dataLength = uint32(len(msg.data))
+	msg.data = CreateSubprotocolDataFrame(msg.data)
 	return nil
 }
 
@@ -151,6 +191,11 @@ func (msg *IAPDataMessage) GetBufferLength() int {
 	return int(msg.dataOffset + msg.dataLength)
 }
 
+// Bytes returns the raw frame backing the message
+func (msg *IAPDataMessage) Bytes() []byte {
+	return msg.data
+}
+
 func (msg *IAPDataMessage) ToString() string {
 	return fmt.Sprintf("Seq: %v, Len: %v, ExpAck: %v, Data: %s \r\n", msg.sequenceNumber, msg.dataLength, msg.GetExpectedAck(), string(msg.data))
 }
@@ -171,12 +216,15 @@ func NewIAPSIDMessage(data []byte) *IAPSidMessage {
 	iapsid := &IAPSidMessage{
 		minimumExpectedLength: uint32(7),
 		dataOffset:            uint32(6),
+		maxTotalLength:        uint32(65535),
 		data:                  data,
 	}
+	iapsid.maxDataLength = iapsid.maxTotalLength - iapsid.dataOffset
 	return iapsid
 }
 func (msg *IAPSidMessage) GetTag() MessageTag {
-	return getTag(msg.data, 0)
+	tag, _ := getTag(msg.data, 0)
+	return tag
 }
 func (msg *IAPSidMessage) SetTag(tag MessageTag) {
 	msg.tag = tag
@@ -194,16 +242,20 @@ func (msg *IAPSidMessage) GetExpectedAck() uint64 {
 	return msg.sequenceNumber + uint64(msg.dataLength)
 }
 
-func (msg *IAPSidMessage) GetDataLength() uint32 {
+// GetDataLength returns the SID length the frame header declares.
+func (msg *IAPSidMessage) GetDataLength() (uint32, error) {
 	return decodeUint32(msg.data, 2)
 }
 
 func (msg *IAPSidMessage) SetDataLength(value uint32) error {
-	if value < 0 || value > msg.maxDataLength {
+	if value > msg.maxDataLength {
 		return errors.New("value out of range")
 	}
-	newData := encodeUint32(value, msg.data, 2)
-	msg.dataLength = uint32(len(newData))
+	newData, err := encodeUint32(value, msg.data, 2)
+	if err != nil {
+		return err
+	}
+	msg.dataLength = value
 	msg.data = newData
 	return nil
 }
@@ -212,13 +264,34 @@ func (msg *IAPSidMessage) GetBufferLength() int {
 	return int(msg.dataOffset + msg.dataLength)
 }
 
-func (msg *IAPSidMessage) GetSID() string {
-	newData := msg.data[msg.dataOffset:msg.GetDataLength()]
-	return string(newData)
+// GetSID returns the SID, checking it fits in the declared length.
+func (msg *IAPSidMessage) GetSID() (string, error) {
+	length, err := msg.GetDataLength()
+	if err != nil {
+		return "", err
+	}
+	if length > msg.maxDataLength {
+		return "", fmt.Errorf("%w: declared %d bytes", ErrFrameLength, length)
+	}
+	end := int(msg.dataOffset) + int(length)
+	err = checkBounds(msg.data, int(msg.dataOffset), int(length))
+	if err != nil {
+		return "", err
+	}
+	return string(msg.data[msg.dataOffset:end]), nil
+}
+
+// Bytes returns the raw frame backing the message
+func (msg *IAPSidMessage) Bytes() []byte {
+	return msg.data
 }
 
 func (msg *IAPSidMessage) ToString() string {
-	return fmt.Sprintf("SID: %v", msg.GetSID())
+	sid, err := msg.GetSID()
+	if err != nil {
+		return fmt.Sprintf("SID: %v", err)
+	}
+	return fmt.Sprintf("SID: %v", sid)
 }
 
 type IAPAckMessage struct {
@@ -234,20 +307,29 @@ type IAPAckMessage struct {
 	tag            MessageTag
 }
 
+// NewIAPAckMessage wraps data as an ack frame, data shorter than
+// an ack frame is padded so the setters always have room.
 func NewIAPAckMessage(data []byte) *IAPAckMessage {
 	iapack := &IAPAckMessage{
 		data:           data,
 		expectedLength: uint32(10),
 		ackOffset:      uint32(2),
 	}
+	if len(data) < int(iapack.expectedLength) {
+		iapack.data = make([]byte, iapack.expectedLength)
+		copy(iapack.data, data)
+	}
 	return iapack
 }
 
 func (msg *IAPAckMessage) GetTag() MessageTag {
-	return getTag(msg.data, 0)
+	tag, _ := getTag(msg.data, 0)
+	return tag
 }
+
+// SetTag can't fail since the constructor makes room for the tag.
 func (msg *IAPAckMessage) SetTag(tag MessageTag) {
-	newData := encodeUint16(uint16(tag), msg.data, 0)
+	newData, _ := encodeUint16(uint16(tag), msg.data, 0)
 	msg.data = newData
 	msg.tag = tag
 }
@@ -260,20 +342,26 @@ func (msg *IAPAckMessage) SetSequenceNumber(sequenceNumber uint64) {
 	msg.sequenceNumber = sequenceNumber
 }
 
-func (msg *IAPAckMessage) GetAck() uint64 {
-	return decodeUint64(msg.data, 2)
+func (msg *IAPAckMessage) GetAck() (uint64, error) {
+	return decodeUint64(msg.data, int(msg.ackOffset))
 }
 
+// SetAck can't fail since the constructor makes room for the ack.
 func (msg *IAPAckMessage) SetAck(value uint64) {
-	newData := encodeUint64(value, msg.data, 2)
+	newData, _ := encodeUint64(value, msg.data, int(msg.ackOffset))
 	msg.data = newData
-	msg.ack = uint64(len(newData))
+	msg.ack = value
 }
 
 func (msg *IAPAckMessage) GetBufferLength() int {
 	return 10
 }
 
+// Bytes returns the raw frame backing the message
+func (msg *IAPAckMessage) Bytes() []byte {
+	return msg.data
+}
+
 func (msg *IAPAckMessage) ToString() string {
 	return fmt.Sprintf("Ack: %v", msg.ack)
 }
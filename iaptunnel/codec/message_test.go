@@ -0,0 +1,146 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// frame builds a frame with a length prefixed body for the tags that
+// carry one and a raw body for the rest.
+func frame(tag MessageTag, body []byte) []byte {
+	data := make([]byte, 2, 6+len(body))
+	binary.BigEndian.PutUint16(data, uint16(tag))
+	switch tag {
+	case MessageConnectSuccessSid, MessageData:
+		data = data[:6]
+		binary.BigEndian.PutUint32(data[2:], uint32(len(body)))
+	}
+	return append(data, body...)
+}
+
+func addMessageSeeds(f *testing.F) {
+	for tag := MessageTagUnused; tag <= MessageAck; tag++ {
+		f.Add(frame(tag, nil))
+		f.Add(frame(tag, []byte("payload")))
+		f.Add(frame(tag, []byte{0, 0, 0, 0, 0, 0, 0x10, 0}))
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0})
+	f.Add([]byte{0, 4, 0xff, 0xff, 0xff, 0xff})
+}
+
+func FuzzMessage(f *testing.F) {
+	addMessageSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg := NewIAPMessage(data)
+		tag := msg.PeekMessageTag()
+		if len(data) < 2 && tag != MessageTagUnused {
+			t.Errorf("tag %d from %d bytes", tag, len(data))
+		}
+		dataMsg := msg.AsDataMessage()
+		if payload, err := dataMsg.GetData(); err == nil {
+			length, _ := dataMsg.GetDataLength()
+			if int(length) != len(payload) || len(payload)+6 != len(data) {
+				t.Errorf("payload of %d bytes, declared %d, frame %d", len(payload), length, len(data))
+			}
+		}
+		if sid, err := msg.AsConnectSIDMessage().GetSID(); err == nil && len(sid)+6 > len(data) {
+			t.Errorf("sid of %d bytes from %d byte frame", len(sid), len(data))
+		}
+		if ack, err := NewIAPAckMessage(data).GetAck(); err == nil && len(data) >= 10 && ack != binary.BigEndian.Uint64(data[2:]) {
+			t.Errorf("ack = %d", ack)
+		}
+	})
+}
+
+func FuzzDecoder(f *testing.F) {
+	addMessageSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for split := 0; split <= len(data); split++ {
+			d := NewDecoder()
+			d.Write(data[:split])
+			d.Write(data[split:])
+			total := 0
+			for {
+				next, err := d.Next()
+				if err != nil || next == nil {
+					break
+				}
+				n, err := FrameLength(next)
+				if err != nil || n != len(next) {
+					t.Fatalf("frame of %d bytes, FrameLength = %d, %v", len(next), n, err)
+				}
+				total += len(next)
+			}
+			if total > len(data) {
+				t.Fatalf("decoded %d bytes out of %d", total, len(data))
+			}
+		}
+	})
+}
+
+func FuzzDataFrameRoundTrip(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte("hello"))
+	f.Add(bytes.Repeat([]byte{0xff}, 300))
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		msg := NewIAPDataMessage(payload)
+		err := msg.CreateDataFrame()
+		if err != nil {
+			t.Skip()
+		}
+		if msg.GetTag() != MessageData {
+			t.Errorf("tag = %d", msg.GetTag())
+		}
+		got, err := NewIAPDataMessage(msg.Bytes()).GetData()
+		if err != nil || !bytes.Equal(got, payload) {
+			t.Errorf("GetData = %q, %v", got, err)
+		}
+		if msg.GetExpectedAck() != uint64(len(payload)) {
+			t.Errorf("expected ack = %d", msg.GetExpectedAck())
+		}
+		d := NewDecoder()
+		d.Write(msg.Bytes())
+		next, err := d.Next()
+		if err != nil || !bytes.Equal(next, msg.Bytes()) {
+			t.Errorf("Decoder.Next = %v, %v", next, err)
+		}
+	})
+}
+
+func FuzzSIDRoundTrip(f *testing.F) {
+	f.Add("")
+	f.Add("a-sid")
+	f.Fuzz(func(t *testing.T, sid string) {
+		msg := NewIAPSIDMessage(frame(MessageConnectSuccessSid, []byte(sid)))
+		got, err := msg.GetSID()
+		if err != nil || got != sid {
+			t.Errorf("GetSID = %q, %v", got, err)
+		}
+		if msg.GetTag() != MessageConnectSuccessSid {
+			t.Errorf("tag = %d", msg.GetTag())
+		}
+	})
+}
+
+func FuzzAckRoundTrip(f *testing.F) {
+	f.Add(uint64(0), uint16(MessageAck))
+	f.Add(uint64(1)<<40+5, uint16(MessageReconnectSuccessAck))
+	f.Fuzz(func(t *testing.T, ack uint64, tag uint16) {
+		msg := NewIAPAckMessage(nil)
+		msg.SetTag(MessageTag(tag))
+		msg.SetAck(ack)
+		got, err := NewIAPAckMessage(msg.Bytes()).GetAck()
+		if err != nil || got != ack {
+			t.Errorf("GetAck = %d, %v", got, err)
+		}
+		if msg.GetTag() != MessageTag(tag) {
+			t.Errorf("tag = %d", msg.GetTag())
+		}
+		frame, err := CreateSubprotocolAckFrame(int(ack))
+		if err == nil && MessageTag(tag) == MessageAck && int(ack) >= 0 && !bytes.Equal(frame, msg.Bytes()) {
+			t.Errorf("CreateSubprotocolAckFrame = %v, want %v", frame, msg.Bytes())
+		}
+	})
+}
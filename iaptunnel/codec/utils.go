@@ -0,0 +1,112 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// every binary struct pack that google does seems to be in big endian
+
+/*
+SUBPROTOCOL_TAG_CONNECT_SUCCESS_SID = 0x0001
+SUBPROTOCOL_TAG_RECONNECT_SUCCESS_ACK = 0x0002
+SUBPROTOCOL_TAG_DATA = 0x0004
+SUBPROTOCOL_TAG_ACK = 0x0007
+
+  return (struct.unpack(str('>H'), binary_data[:2])[0],
+          binary_data[2:])
+*/
+//tag, bytes_left = utils.ExtractSubprotocolTag(binary_data)
+func ExtractSubProtocolTag(data []byte) (uint16, []byte, error) {
+	if len(data) < 2 {
+		return 0, nil, fmt.Errorf("incomplete data")
+	}
+	i := binary.BigEndian.Uint16(data[:2])
+	return i, data[2:], nil
+}
+
+func HandleSubprotocolConnectSuccessSid(data []byte) ([]byte, []byte, error) {
+	return ExtractSubprotocolConnectSuccessSid(data)
+}
+
+func ExtractSubprotocolConnectSuccessSid(data []byte) ([]byte, []byte, error) {
+	nextBytes, binaryData, err := ExtractUnsignedInt32(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ExtractBinaryArray(binaryData, int(nextBytes))
+}
+
+func ExtractUnsignedInt32(data []byte) (uint32, []byte, error) {
+	if len(data) < 4 {
+		return 0, nil, fmt.Errorf("incomplete data")
+	}
+	dataLength := binary.BigEndian.Uint32(data[:4])
+	return dataLength, data[4:], nil
+}
+
+func ExtractUnsignedInt64(data []byte) (uint64, []byte, error) {
+	if len(data) < 8 {
+		return 0, nil, fmt.Errorf("incomplete data")
+	}
+	value := binary.BigEndian.Uint64(data[:8])
+	return value, data[8:], nil
+}
+
+func ExtractBinaryArray(data []byte, dataLen int) ([]byte, []byte, error) {
+	if len(data) < dataLen {
+		return nil, nil, fmt.Errorf("incomplete data")
+	}
+
+	return data[:dataLen], data[dataLen:], nil
+}
+
+func HandleSubprotocolData(data []byte) ([]byte, []byte, error) {
+	nextBytes, binaryData, err := ExtractUnsignedInt32(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ExtractBinaryArray(binaryData, int(nextBytes))
+}
+
+// HandleSubprotocolAck reads the byte count of an ack or
+// reconnect success ack frame.
+func HandleSubprotocolAck(data []byte) (uint64, []byte, error) {
+	return ExtractUnsignedInt64(data)
+}
+
+type ackFrameLayout struct {
+	Tag      uint16
+	Received uint64
+}
+
+// CreateSubprotocolAckFrame builds the ack frame for bytesReceived.
+// Q is uint64
+// H is uint16
+func CreateSubprotocolAckFrame(bytesReceived int) ([]byte, error) {
+	af := ackFrameLayout{
+		Tag:      7,
+		Received: uint64(bytesReceived),
+	}
+	buf := &bytes.Buffer{}
+	err := binary.Write(buf, binary.BigEndian, af)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// dataFrameHeaderSize is the tag and the uint32 length in front
+// of the data.
+const dataFrameHeaderSize = 6
+
+// CreateSubprotocolDataFrame prefixes data with a data frame header.
+// I is uint32
+func CreateSubprotocolDataFrame(data []byte) []byte {
+	frame := make([]byte, dataFrameHeaderSize+len(data))
+	binary.BigEndian.PutUint16(frame, uint16(MessageData))
+	binary.BigEndian.PutUint32(frame[2:], uint32(len(data)))
+	copy(frame[dataFrameHeaderSize:], data)
+	return frame
+}
@@ -0,0 +1,222 @@
+package iaptunnel
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// cloudPlatformScope is what tunnel tokens are requested for.
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// the credential file types google.CredentialsFromJSON understands
+const (
+	serviceAccountCredentials  = "service_account"
+	externalAccountCredentials = "external_account"
+	authorizedUserCredentials  = "authorized_user"
+)
+
+// impersonatedTokenLifetime is the longest IAM Credentials hands out
+// without an org policy raising it.
+const impersonatedTokenLifetime = time.Hour
+
+// DefaultTokenSource returns the application default credentials,
+// the same ones gcloud's --application-default login sets up.
+func DefaultTokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	cred, err := google.FindDefaultCredentials(ctx, cloudPlatformScope)
+	if err != nil {
+		return nil, &AuthError{Err: err}
+	}
+	return cred.TokenSource, nil
+}
+
+// CredentialsFileTokenSource reads a service account key, a workload
+// identity federation config or authorized user credentials from path.
+func CredentialsFileTokenSource(ctx context.Context, path string) (oauth2.TokenSource, error) {
+	return credentialsFileTokenSource(ctx, path)
+}
+
+// ServiceAccountKeyTokenSource reads a service account key file.
+func ServiceAccountKeyTokenSource(ctx context.Context, path string) (oauth2.TokenSource, error) {
+	return credentialsFileTokenSource(ctx, path, serviceAccountCredentials)
+}
+
+// WorkloadIdentityFederationTokenSource reads a workload identity
+// federation config, as written by gcloud iam workload-identity-pools
+// create-cred-config.
+func WorkloadIdentityFederationTokenSource(ctx context.Context, path string) (oauth2.TokenSource, error) {
+	return credentialsFileTokenSource(ctx, path, externalAccountCredentials)
+}
+
+// credentialsFileTokenSource reads the credentials file at path, which
+// has to be one of types if any are given.
+func credentialsFileTokenSource(ctx context.Context, path string, types ...string) (oauth2.TokenSource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, &AuthError{Err: err}
+	}
+	var file struct {
+		Type string `json:"type"`
+	}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, &AuthError{Err: fmt.Errorf("%s: %w", path, err)}
+	}
+	if len(types) > 0 && !containsString(types, file.Type) {
+		return nil, &AuthError{Err: fmt.Errorf("%s has %q credentials, not %s", path, file.Type, strings.Join(types, " or "))}
+	}
+	cred, err := google.CredentialsFromJSON(ctx, data, cloudPlatformScope)
+	if err != nil {
+		return nil, &AuthError{Err: fmt.Errorf("%s: %w", path, err)}
+	}
+	return cred.TokenSource, nil
+}
+
+// ImpersonatedTokenSource returns tokens of serviceAccount, generated by
+// IAM Credentials with the tokens of base. base needs the Service
+// Account Token Creator role on serviceAccount, or on the first of
+// delegates which then each need it on the next.
+func ImpersonatedTokenSource(ctx context.Context, base oauth2.TokenSource, serviceAccount string, delegates ...string) (oauth2.TokenSource, error) {
+	service, err := iamcredentials.NewService(ctx, option.WithTokenSource(base))
+	if err != nil {
+		return nil, err
+	}
+	ts := &impersonatedTokenSource{
+		service:        service,
+		serviceAccount: serviceAccount,
+	}
+	for _, delegate := range delegates {
+		ts.delegates = append(ts.delegates, serviceAccountResource(delegate))
+	}
+	return ts, nil
+}
+
+type impersonatedTokenSource struct {
+	service        *iamcredentials.Service
+	serviceAccount string
+	delegates      []string
+}
+
+func (ts *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	resp, err := ts.service.Projects.ServiceAccounts.GenerateAccessToken(
+		serviceAccountResource(ts.serviceAccount),
+		&iamcredentials.GenerateAccessTokenRequest{
+			Delegates: ts.delegates,
+			Lifetime:  fmt.Sprintf("%ds", int(impersonatedTokenLifetime.Seconds())),
+			Scope:     []string{cloudPlatformScope},
+		}).Do()
+	if err != nil {
+		return nil, &AuthError{Err: fmt.Errorf("impersonating %s: %w", ts.serviceAccount, err)}
+	}
+	expiry, err := time.Parse(time.RFC3339, resp.ExpireTime)
+	if err != nil {
+		return nil, &AuthError{Err: fmt.Errorf("impersonating %s: bad expire time: %w", ts.serviceAccount, err)}
+	}
+	return &oauth2.Token{
+		AccessToken: resp.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      expiry,
+	}, nil
+}
+
+func serviceAccountResource(email string) string {
+	return "projects/-/serviceAccounts/" + email
+}
+
+// GcloudUserTokenSource uses the credentials gcloud auth login stored
+// for account, or for gcloud's active account when it's empty.
+func GcloudUserTokenSource(ctx context.Context, account string) (oauth2.TokenSource, error) {
+	configDir, err := gcloudConfigDir()
+	if err != nil {
+		return nil, &AuthError{Err: err}
+	}
+	if account == "" {
+		account, err = gcloudActiveAccount(configDir)
+		if err != nil {
+			return nil, &AuthError{Err: err}
+		}
+	}
+	// gcloud keeps a copy of every account's credentials in the
+	// application default credentials format next to its database
+	path := filepath.Join(configDir, "legacy_credentials", account, "adc.json")
+	_, err = os.Stat(path)
+	if err != nil {
+		return nil, &AuthError{Err: fmt.Errorf("no gcloud credentials for %s, run gcloud auth login: %w", account, err)}
+	}
+	return credentialsFileTokenSource(ctx, path, authorizedUserCredentials, serviceAccountCredentials, externalAccountCredentials)
+}
+
+// gcloudConfigDir returns where gcloud keeps its configuration.
+func gcloudConfigDir() (string, error) {
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return dir, nil
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "gcloud"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "gcloud"), nil
+}
+
+// gcloudActiveAccount reads the account of gcloud's active configuration.
+func gcloudActiveAccount(configDir string) (string, error) {
+	if account := os.Getenv("CLOUDSDK_CORE_ACCOUNT"); account != "" {
+		return account, nil
+	}
+	name := os.Getenv("CLOUDSDK_ACTIVE_CONFIG_NAME")
+	if name == "" {
+		data, err := os.ReadFile(filepath.Join(configDir, "active_config"))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		name = strings.TrimSpace(string(data))
+	}
+	if name == "" {
+		name = "default"
+	}
+	f, err := os.Open(filepath.Join(configDir, "configurations", "config_"+name))
+	if err != nil {
+		return "", fmt.Errorf("no gcloud account, run gcloud auth login: %w", err)
+	}
+	defer f.Close()
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line[1 : len(line)-1]
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if ok && section == "core" && strings.TrimSpace(key) == "account" {
+			return strings.TrimSpace(value), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("gcloud configuration %s has no account, run gcloud auth login", name)
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
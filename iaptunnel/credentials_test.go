@@ -0,0 +1,162 @@
+package iaptunnel
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	authorizedUserJSON = `{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "token"}`
+	serviceAccountJSON = `{"type": "service_account", "client_email": "sa@test-project.iam.gserviceaccount.com", "private_key": "key", "token_uri": "https://oauth2.googleapis.com/token"}`
+)
+
+// writeFile writes content to name under dir, making the directories.
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err == nil {
+		err = os.WriteFile(path, []byte(content), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCredentialsFileTokenSource(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		types   []string
+		wantErr string
+	}{
+		{"any type", authorizedUserJSON, nil, ""},
+		{"wanted type", serviceAccountJSON, []string{serviceAccountCredentials}, ""},
+		{"one of the wanted types", authorizedUserJSON, []string{serviceAccountCredentials, authorizedUserCredentials}, ""},
+		{"other type", authorizedUserJSON, []string{serviceAccountCredentials}, `has "authorized_user" credentials, not service_account`},
+		{"no type", `{}`, []string{externalAccountCredentials}, `has "" credentials, not external_account`},
+		{"not json", `not json`, nil, "invalid character"},
+		{"unknown type", `{"type": "nonsense"}`, nil, "nonsense"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, t.TempDir(), "credentials.json", tt.content)
+			ts, err := credentialsFileTokenSource(context.Background(), path, tt.types...)
+			if tt.wantErr == "" {
+				if err != nil || ts == nil {
+					t.Fatalf("credentialsFileTokenSource = %v, %v", ts, err)
+				}
+				return
+			}
+			var authErr *AuthError
+			if !errors.As(err, &authErr) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("credentialsFileTokenSource = %v, want an AuthError containing %q", err, tt.wantErr)
+			}
+		})
+	}
+	_, err := credentialsFileTokenSource(context.Background(), filepath.Join(t.TempDir(), "missing.json"))
+	var authErr *AuthError
+	if !errors.As(err, &authErr) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file = %v, want an AuthError for it", err)
+	}
+}
+
+func TestGcloudActiveAccount(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		// files are written to the config directory
+		files   map[string]string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "default configuration",
+			files: map[string]string{
+				"configurations/config_default": "[core]\naccount = me@example.com\nproject = my-project\n",
+			},
+			want: "me@example.com",
+		},
+		{
+			name: "active configuration",
+			files: map[string]string{
+				"active_config":                 "work\n",
+				"configurations/config_default": "[core]\naccount = me@example.com\n",
+				"configurations/config_work":    "[compute]\nzone = us-east1-b\n\n[core]\naccount=work@example.com\n",
+			},
+			want: "work@example.com",
+		},
+		{
+			name: "configuration from the environment",
+			env:  map[string]string{"CLOUDSDK_ACTIVE_CONFIG_NAME": "other"},
+			files: map[string]string{
+				"active_config":               "work",
+				"configurations/config_work":  "[core]\naccount = work@example.com\n",
+				"configurations/config_other": "[core]\naccount = other@example.com\n",
+			},
+			want: "other@example.com",
+		},
+		{
+			name: "account from the environment",
+			env:  map[string]string{"CLOUDSDK_CORE_ACCOUNT": "env@example.com"},
+			want: "env@example.com",
+		},
+		{
+			name: "account in another section",
+			files: map[string]string{
+				"configurations/config_default": "[auth]\naccount = me@example.com\n",
+			},
+			wantErr: "gcloud configuration default has no account",
+		},
+		{
+			name:    "no configuration",
+			wantErr: "no gcloud account",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CLOUDSDK_CORE_ACCOUNT", "")
+			t.Setenv("CLOUDSDK_ACTIVE_CONFIG_NAME", "")
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			dir := t.TempDir()
+			for name, content := range tt.files {
+				writeFile(t, dir, name, content)
+			}
+			got, err := gcloudActiveAccount(dir)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("gcloudActiveAccount = %q, %v, want an error containing %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("gcloudActiveAccount = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestGcloudUserTokenSource(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CLOUDSDK_CONFIG", dir)
+	t.Setenv("CLOUDSDK_CORE_ACCOUNT", "")
+	t.Setenv("CLOUDSDK_ACTIVE_CONFIG_NAME", "")
+	writeFile(t, dir, "configurations/config_default", "[core]\naccount = me@example.com\n")
+	writeFile(t, dir, "legacy_credentials/me@example.com/adc.json", authorizedUserJSON)
+	ts, err := GcloudUserTokenSource(context.Background(), "")
+	if err != nil || ts == nil {
+		t.Fatalf("active account = %v, %v", ts, err)
+	}
+	_, err = GcloudUserTokenSource(context.Background(), "someone@example.com")
+	var authErr *AuthError
+	if !errors.As(err, &authErr) || !strings.Contains(err.Error(), "no gcloud credentials for someone@example.com") {
+		t.Errorf("account without credentials = %v, want an AuthError", err)
+	}
+}
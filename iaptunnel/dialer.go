@@ -0,0 +1,103 @@
+package iaptunnel
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// Dialer opens IAP tunnels as net.Conns, the options are applied to
+// every tunnel connection it creates.
+type Dialer struct {
+	opts []TunnelConnectionOption
+	// mu guards targets, the tunnel connection of each instance:port
+	// dialed so far. Each dial is a new session of it, so the instance
+	// is looked up once and the sessions share the token cache.
+	mu      sync.Mutex
+	targets map[string]*dialTarget
+}
+
+// dialTarget is the tunnel connection to one target, tc and err are
+// set once ready is closed.
+type dialTarget struct {
+	ready chan struct{}
+	tc    *TunnelConnection
+	err   error
+}
+
+// NewDialer creates a Dialer, usually configured with WithProject and WithZone.
+func NewDialer(opts ...TunnelConnectionOption) *Dialer {
+	return &Dialer{opts: opts, targets: map[string]*dialTarget{}}
+}
+
+// DialContext opens a tunnel to target, which is formatted as instance:port.
+// The returned connection is ready once IAP has assigned it a SID.
+func (d *Dialer) DialContext(ctx context.Context, target string) (net.Conn, error) {
+	t, err := d.target(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newConn(ctx, t.tc.newSession())
+	if err != nil {
+		if isGoneInstance(err) {
+			// it may have been recreated elsewhere, like by a MIG
+			d.forget(target, t)
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// target returns the tunnel connection to target, the first dial
+// creates it without holding up dials to other targets. One that fails
+// to be created isn't kept.
+func (d *Dialer) target(ctx context.Context, target string) (*dialTarget, error) {
+	d.mu.Lock()
+	t, ok := d.targets[target]
+	if !ok {
+		t = &dialTarget{ready: make(chan struct{})}
+		d.targets[target] = t
+	}
+	d.mu.Unlock()
+	if !ok {
+		t.tc, t.err = d.newTunnelConnection(ctx, target)
+		if t.err != nil {
+			d.forget(target, t)
+		}
+		close(t.ready)
+	}
+	select {
+	case <-t.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if t.err != nil {
+		return nil, t.err
+	}
+	return t, nil
+}
+
+func (d *Dialer) newTunnelConnection(ctx context.Context, target string) (*TunnelConnection, error) {
+	instance, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	opts := make([]TunnelConnectionOption, 0, len(d.opts)+2)
+	opts = append(opts, d.opts...)
+	opts = append(opts, WithInstanceName(instance), WithPort(port))
+	return NewTunnelConnection(ctx, opts...)
+}
+
+// forget drops t so the next dial to target looks the instance up again.
+func (d *Dialer) forget(target string, t *dialTarget) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.targets[target] == t {
+		delete(d.targets, target)
+	}
+}
+
+// DialIAP is shorthand for NewDialer(opts...).DialContext(ctx, target).
+func DialIAP(ctx context.Context, target string, opts ...TunnelConnectionOption) (net.Conn, error) {
+	return NewDialer(opts...).DialContext(ctx, target)
+}
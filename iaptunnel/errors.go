@@ -0,0 +1,179 @@
+package iaptunnel
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"strings"
+)
+
+// ErrNonLoopback is returned when listening on an address that isn't
+// a loopback one without allowing it.
+var ErrNonLoopback = errors.New("listening on a non-loopback address has to be allowed explicitly")
+
+// ErrZoneRequired is returned when the instance check is skipped without
+// a zone, looking the zone up would need compute.instances.list.
+var ErrZoneRequired = errors.New("the zone has to be given when the instance check is skipped")
+
+// Close codes IAP sends when it refuses or ends a tunnel because of
+// the credentials it was given.
+const (
+	closeCodeReauthenticationRequired = 4004
+	closeCodeNotAuthorized            = 4033
+)
+
+// closeCodeLookupFailed is IAP not finding the instance, on connect or
+// on reconnect.
+const (
+	closeCodeLookupFailed          = 4047
+	closeCodeLookupFailedReconnect = 4051
+)
+
+// LocalClosedError means the local client went away, Err is io.EOF when
+// it closed normally.
+type LocalClosedError struct {
+	Err error
+}
+
+func (e *LocalClosedError) Error() string {
+	return "local connection closed: " + e.Err.Error()
+}
+
+func (e *LocalClosedError) Unwrap() error {
+	return e.Err
+}
+
+// TunnelClosedError means the websocket to IAP went away, Err is io.EOF
+// when IAP closed it normally.
+type TunnelClosedError struct {
+	Err error
+}
+
+func (e *TunnelClosedError) Error() string {
+	return "tunnel closed: " + e.Err.Error()
+}
+
+func (e *TunnelClosedError) Unwrap() error {
+	return e.Err
+}
+
+// MTLSError means dialing the mTLS endpoint failed under MTLSAlways,
+// which doesn't fall back to the TLS endpoint.
+type MTLSError struct {
+	Err error
+}
+
+func (e *MTLSError) Error() string {
+	return "mTLS endpoint: " + e.Err.Error()
+}
+
+func (e *MTLSError) Unwrap() error {
+	return e.Err
+}
+
+// ProtocolError means IAP sent something that doesn't follow the
+// relay subprotocol.
+type ProtocolError struct {
+	Err error
+}
+
+func (e *ProtocolError) Error() string {
+	return "protocol error: " + e.Err.Error()
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// AuthError means there were no usable credentials or IAP refused them.
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return "authentication failed: " + e.Err.Error()
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// AmbiguousInstanceError means no zone was given and instances with the
+// name exist in more than one zone of the project.
+type AmbiguousInstanceError struct {
+	Instance string
+	Zones    []string
+}
+
+func (e *AmbiguousInstanceError) Error() string {
+	return fmt.Sprintf("instance %s exists in zones %s, the zone has to be given", e.Instance, strings.Join(e.Zones, ", "))
+}
+
+// InstanceNotFoundError means there's no instance with the name in the
+// zone, or in the whole project when Zone is empty.
+type InstanceNotFoundError struct {
+	Project  string
+	Zone     string
+	Instance string
+}
+
+func (e *InstanceNotFoundError) Error() string {
+	if e.Zone == "" {
+		return fmt.Sprintf("instance %s not found in project %s", e.Instance, e.Project)
+	}
+	return fmt.Sprintf("instance %s not found in zone %s of project %s", e.Instance, e.Zone, e.Project)
+}
+
+// InstanceNotRunningError means the instance exists but IAP can't reach
+// it in its current status, like TERMINATED or STAGING.
+type InstanceNotRunningError struct {
+	Instance string
+	Status   string
+}
+
+func (e *InstanceNotRunningError) Error() string {
+	return fmt.Sprintf("instance %s is %s, not RUNNING", e.Instance, e.Status)
+}
+
+// NetworkInterfaceError means the instance has no network interface
+// called Nic, Available are the ones it has.
+type NetworkInterfaceError struct {
+	Instance  string
+	Nic       string
+	Available []string
+}
+
+func (e *NetworkInterfaceError) Error() string {
+	return fmt.Sprintf("instance %s has no network interface %s, it has %s", e.Instance, e.Nic, strings.Join(e.Available, ", "))
+}
+
+// classifyTunnelError turns the close codes IAP uses for credential
+// problems into an AuthError, and the ones for a missing instance into
+// an InstanceNotFoundError for the instance of tc.
+func classifyTunnelError(tc *TunnelConnection, err error) error {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		switch closeErr.Code {
+		case closeCodeReauthenticationRequired, closeCodeNotAuthorized:
+			return &AuthError{Err: err}
+		case closeCodeLookupFailed, closeCodeLookupFailedReconnect:
+			return &InstanceNotFoundError{Project: tc.project, Zone: tc.zone, Instance: tc.instanceName}
+		}
+	}
+	return err
+}
+
+// isGoneInstance reports whether err means the instance isn't where it
+// was looked up anymore, or can't be tunneled to.
+func isGoneInstance(err error) bool {
+	var notFound *InstanceNotFoundError
+	var notRunning *InstanceNotRunningError
+	return errors.As(err, &notFound) || errors.As(err, &notRunning)
+}
+
+// isCleanClose reports whether err is one end closing normally rather
+// than something failing.
+func isCleanClose(err error) bool {
+	return err == nil || errors.Is(err, io.EOF)
+}
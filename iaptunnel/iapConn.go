@@ -0,0 +1,497 @@
+package iaptunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/eahrend/gcp-iap-tunnel-parser/iaptunnel/codec"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// going off of max size from the python library
+	maxDataFrameSize    = 16384
+	minReconnectBackoff = 100 * time.Millisecond
+	maxReconnectBackoff = 5 * time.Second
+	// a second reauthentication request this soon after the last one
+	// means a fresh token didn't help
+	minReauthInterval = time.Minute
+)
+
+// Conn is a net.Conn carrying raw TCP bytes to the instance port,
+// the subprotocol framing, acking and SID handling happen inside.
+type Conn struct {
+	// latency is the last measured round trip in nanoseconds, it's
+	// first to keep it aligned for atomic access.
+	latency int64
+	tc      *TunnelConnection
+	decoder *codec.Decoder
+	ctx     context.Context
+	cancel  context.CancelFunc
+	// writeMu keeps the frames of a single Write together
+	writeMu sync.Mutex
+	// sendMu keeps frames going out in sequence order, between
+	// Write and the replay after a reconnect.
+	sendMu        sync.Mutex
+	sendBuf       *sendBuffer
+	reconnecting  bool
+	sendErr       error
+	recvCh        chan []byte
+	pending       []byte
+	readMu        sync.Mutex
+	readErr       error
+	connected     chan struct{}
+	connectOnce   sync.Once
+	done          chan struct{}
+	closed        chan struct{}
+	closeOnce     sync.Once
+	closeErr      error
+	readDeadline  deadline
+	deadlineMu    sync.Mutex
+	writeDeadline time.Time
+	// start is the zero point of latency probe timestamps, probes are
+	// the ones sent and not answered yet, oldest first.
+	start    time.Time
+	probesMu sync.Mutex
+	probes   []uint64
+	// lastReauth is when IAP last asked for a new token, only
+	// the read loop uses it.
+	lastReauth time.Time
+	// localAddr is the websocket's address when the tunnel opened, it
+	// stays put through reconnects and after Close.
+	localAddr net.Addr
+}
+
+// Addr is the address of the far end of an IAP tunnel.
+type Addr struct {
+	Project  string
+	Zone     string
+	Instance string
+	Nic      string
+	Port     string
+}
+
+// Network returns "iap".
+func (a *Addr) Network() string {
+	return "iap"
+}
+
+func (a *Addr) String() string {
+	return fmt.Sprintf("%s/%s/%s/%s:%s", a.Project, a.Zone, a.Instance, a.Nic, a.Port)
+}
+
+// newConn connects tc to the websocket and waits for IAP to hand out
+// a SID before returning.
+func newConn(ctx context.Context, tc *TunnelConnection) (*Conn, error) {
+	err := tc.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return startConn(ctx, tc)
+}
+
+// startConn starts reading off of an already connected tc.
+func startConn(ctx context.Context, tc *TunnelConnection) (*Conn, error) {
+	connCtx, cancel := context.WithCancel(context.Background())
+	c := &Conn{
+		tc:           tc,
+		decoder:      codec.NewDecoder(),
+		ctx:          connCtx,
+		cancel:       cancel,
+		sendBuf:      newSendBuffer(tc.sendBufferSize),
+		recvCh:       make(chan []byte, 16),
+		connected:    make(chan struct{}),
+		done:         make(chan struct{}),
+		closed:       make(chan struct{}),
+		readDeadline: makeDeadline(),
+		start:        time.Now(),
+		localAddr:    &net.TCPAddr{},
+	}
+	if ws := tc.ws(); ws != nil {
+		c.localAddr = ws.LocalAddr()
+	}
+	go c.readLoop()
+	select {
+	case <-c.connected:
+		if tc.latencyProbeInterval > 0 {
+			go c.probeLatency(tc.latencyProbeInterval)
+		}
+		return c, nil
+	case <-c.done:
+		c.Close()
+		return nil, c.readErr
+	case <-ctx.Done():
+		c.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// readLoop reads frames off of the websocket until it's closed, data
+// gets acked and handed to Read. A dropped websocket is reconnected.
+func (c *Conn) readLoop() {
+	defer close(c.done)
+	defer close(c.recvCh)
+	for {
+		msg, err := c.tc.readMessage()
+		if err != nil {
+			if !c.shouldReconnect(err) {
+				c.fail(c.mapReadError(err))
+				return
+			}
+			err = c.reconnect(err)
+			if err != nil {
+				c.fail(classifyTunnelError(c.tc, err))
+				return
+			}
+			continue
+		}
+		err = c.handleMessage(msg)
+		if err != nil {
+			c.fail(err)
+			c.tc.Close()
+			return
+		}
+	}
+}
+
+// handleMessage splits a websocket message into frames, a frame split
+// across messages is held until the rest of it arrives.
+func (c *Conn) handleMessage(msg []byte) error {
+	c.decoder.Write(msg)
+	for {
+		frame, err := c.decoder.NextFrame()
+		if err != nil {
+			return &ProtocolError{Err: err}
+		}
+		if frame == nil {
+			return nil
+		}
+		err = c.handleFrame(frame)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Conn) handleFrame(frame codec.Frame) error {
+	switch f := frame.(type) {
+	case *codec.ConnectSuccessSidFrame:
+		c.tc.SetSid(f.SID)
+		c.connectOnce.Do(func() { close(c.connected) })
+	case *codec.ReconnectSuccessAckFrame:
+		return c.resume(f.Ack)
+	case *codec.DataFrame:
+		// only the payload goes to Read, not the frame header
+		if len(f.Data) == 0 {
+			return nil
+		}
+		err := c.ack(uint64(len(f.Data)))
+		if err != nil {
+			return err
+		}
+		select {
+		case c.recvCh <- f.Data:
+		case <-c.closed:
+			return net.ErrClosed
+		}
+	case *codec.AckFrame:
+		err := c.sendBuf.confirm(f.Ack)
+		if err != nil {
+			return &ProtocolError{Err: err}
+		}
+	case *codec.AckLatencyFrame:
+		return c.answerLatencyProbe(f)
+	case *codec.ReplyLatencyFrame:
+		c.handleLatencyReply(f)
+	default:
+		return &ProtocolError{Err: fmt.Errorf("unexpected frame: %d", frame.Tag())}
+	}
+	return nil
+}
+
+// ack records n received bytes and acks everything received so far.
+func (c *Conn) ack(n uint64) error {
+	c.tc.bytesReceived += n
+	ackFrame, err := codec.CreateSubprotocolAckFrame(int(c.tc.bytesReceived))
+	if err != nil {
+		return err
+	}
+	err = c.writeFrame(ackFrame, time.Time{})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// writeFrame writes frame to the websocket. If the tunnel can be
+// reconnected a failed write drops the websocket and reports success,
+// the read loop then reconnects and the frame is acked or replayed.
+func (c *Conn) writeFrame(frame []byte, deadline time.Time) error {
+	_, err := c.tc.writeMessage(frame, deadline)
+	if err != nil && c.canReconnect() {
+		c.tc.dropWebsocket()
+		return nil
+	}
+	return err
+}
+
+func (c *Conn) canReconnect() bool {
+	return c.tc.reconnectTimeout > 0 && c.tc.GetSid() != "" && !isClosedChan(c.closed)
+}
+
+// shouldReconnect reports whether err is a dropped websocket rather than
+// the tunnel being closed on purpose.
+func (c *Conn) shouldReconnect(err error) bool {
+	if !c.canReconnect() {
+		return false
+	}
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		// the token expired, reconnecting dials with a fresh one
+		if closeErr.Code == closeCodeReauthenticationRequired {
+			if time.Since(c.lastReauth) < minReauthInterval {
+				return false
+			}
+			c.lastReauth = time.Now()
+			return true
+		}
+		// 1000 is a normal close and 4000 and up are IAP refusing the
+		// tunnel, neither of which a reconnect will fix.
+		return closeErr.Code != websocket.CloseNormalClosure && closeErr.Code < 4000
+	}
+	return true
+}
+
+// reconnect retries the reconnect endpoint with backoff until it works or
+// the reconnect timeout runs out. Writes are only buffered meanwhile.
+func (c *Conn) reconnect(cause error) error {
+	c.sendMu.Lock()
+	c.reconnecting = true
+	c.sendMu.Unlock()
+	c.tc.dropWebsocket()
+	// IAP resends whatever we didn't ack, including a partial frame
+	c.decoder.Reset()
+	giveUp := time.Now().Add(c.tc.reconnectTimeout)
+	backoff := minReconnectBackoff
+	for {
+		err := c.tc.Reconnect(c.ctx)
+		if err == nil {
+			// a Close while the dial was finishing found no websocket
+			// to close, the new one mustn't outlive it
+			if isClosedChan(c.closed) {
+				c.tc.Close()
+				return net.ErrClosed
+			}
+			return nil
+		}
+		if isClosedChan(c.closed) {
+			return net.ErrClosed
+		}
+		// retrying won't fix credentials IAP refused
+		var authErr *AuthError
+		if errors.As(err, &authErr) || time.Now().Add(backoff).After(giveUp) {
+			return fmt.Errorf("failed to reconnect after %w: %w", cause, err)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-c.closed:
+			return net.ErrClosed
+		}
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// resume drops what IAP got before the websocket dropped and replays the rest.
+func (c *Conn) resume(ack uint64) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	err := c.sendBuf.confirm(ack)
+	if err != nil {
+		return &ProtocolError{Err: err}
+	}
+	c.reconnecting = false
+	for _, msg := range c.sendBuf.unacked() {
+		err := c.writeFrame(msg.Bytes(), time.Time{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fail records err as the reason the tunnel stopped.
+func (c *Conn) fail(err error) {
+	c.readErr = err
+	c.sendMu.Lock()
+	c.sendErr = err
+	c.sendMu.Unlock()
+}
+
+// mapReadError turns websocket errors into the errors net.Conn
+// users expect, IAP refusing the credentials becomes an AuthError.
+func (c *Conn) mapReadError(err error) error {
+	if isClosedChan(c.closed) {
+		return net.ErrClosed
+	}
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		return io.EOF
+	}
+	return classifyTunnelError(c.tc, err)
+}
+
+// Read reads payload bytes sent by the instance.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(c.pending) == 0 {
+		if isClosedChan(c.closed) {
+			return 0, net.ErrClosed
+		}
+		select {
+		case data, ok := <-c.recvCh:
+			if !ok {
+				return 0, c.readErr
+			}
+			c.pending = data
+		case <-c.closed:
+			return 0, net.ErrClosed
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends b to the instance, split into data frames. Frames are kept
+// until IAP acks them so they can be replayed after a reconnect, Write
+// blocks while the send buffer is full.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for len(b) > 0 {
+		if isClosedChan(c.closed) {
+			return written, net.ErrClosed
+		}
+		deadline := c.getWriteDeadline()
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+		n := len(b)
+		if n > maxDataFrameSize {
+			n = maxDataFrameSize
+		}
+		err := c.sendBuf.waitForSpace(n, deadline, c.done)
+		if err != nil {
+			return written, c.writeErr(err)
+		}
+		c.sendMu.Lock()
+		if c.sendErr != nil {
+			err = c.sendErr
+			c.sendMu.Unlock()
+			return written, err
+		}
+		msg, err := c.sendBuf.push(b[:n])
+		if err == nil && !c.reconnecting {
+			err = c.writeFrame(msg.Bytes(), deadline)
+		}
+		c.sendMu.Unlock()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				err = os.ErrDeadlineExceeded
+			}
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Drain waits until IAP has acked everything written so far, or until
+// ctx is done. Call it before Close to make sure no data gets dropped.
+func (c *Conn) Drain(ctx context.Context) error {
+	err := c.sendBuf.waitForEmpty(ctx, c.done)
+	if err != nil {
+		return c.writeErr(err)
+	}
+	return nil
+}
+
+// writeErr prefers the reason the tunnel failed over net.ErrClosed.
+func (c *Conn) writeErr(err error) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if errors.Is(err, net.ErrClosed) && c.sendErr != nil {
+		return c.sendErr
+	}
+	return err
+}
+
+// Close sends a close frame to IAP and closes the websocket.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.cancel()
+		err := c.tc.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			c.closeErr = err
+		}
+	})
+	return c.closeErr
+}
+
+// LocalAddr returns the local address the websocket was opened from.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// RemoteAddr returns the instance the tunnel ends at.
+func (c *Conn) RemoteAddr() net.Addr {
+	return &Addr{
+		Project:  c.tc.project,
+		Zone:     c.tc.zone,
+		Instance: c.tc.instanceName,
+		Nic:      c.tc.nic,
+		Port:     c.tc.port,
+	}
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+func (c *Conn) getWriteDeadline() time.Time {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	return c.writeDeadline
+}
+
+// GetSid returns the SID IAP assigned to the tunnel.
+func (c *Conn) GetSid() string {
+	return c.tc.GetSid()
+}
@@ -0,0 +1,572 @@
+// Package iaptest runs a fake IAP relay in process. It speaks the
+// relay.tunnel.cloudproxy.app subprotocol and relays every tunnel to a
+// local TCP backend, so tunnels can be tested without a network.
+package iaptest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/eahrend/gcp-iap-tunnel-parser/iaptunnel/codec"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	subProtocolName = "relay.tunnel.cloudproxy.app"
+	// maxDataSize is the most payload the server puts in one DATA frame
+	maxDataSize = 16384
+)
+
+// close codes the real relay uses for the failures the fake can have
+const (
+	CloseCodeSIDUnknown               = 4001
+	CloseCodeFailedToConnectToBackend = 4003
+	CloseCodeReauthenticationRequired = 4004
+	CloseCodeNotAuthorized            = 4033
+	CloseCodeLookupFailed             = 4047
+	badTag                            = 0x7fff
+)
+
+// Faults are what the server gets wrong on purpose, the zero value is a
+// well behaved relay.
+type Faults struct {
+	// Delay is waited before every websocket message the server sends.
+	Delay time.Duration
+	// SplitFrames sends every frame in two websocket messages.
+	SplitFrames bool
+	// BadTag sends a frame with an unknown tag right after the SID.
+	BadTag bool
+	// DropAfter drops the websocket, without a close frame, when relaying
+	// data to the client would take it past this many bytes. The data is
+	// replayed after a reconnect. Zero never drops.
+	DropAfter int
+	// RefuseConnect closes new tunnels with this close code instead of
+	// connecting them, like CloseCodeLookupFailed. Zero connects them.
+	RefuseConnect int
+}
+
+// Connect is a connect request the server got.
+type Connect struct {
+	Query url.Values
+	// ClientCertificate is the certificate the client presented, only a
+	// TLS server asks for one.
+	ClientCertificate *x509.Certificate
+}
+
+// Server is a fake relay, every tunnel it accepts is connected to the
+// backend whatever instance and port it asks for.
+type Server struct {
+	// URL is the base URL to dial, ws://127.0.0.1:port or wss:// for a
+	// TLS server
+	URL string
+
+	backend  string
+	srv      *httptest.Server
+	upgrader websocket.Upgrader
+
+	mu         sync.Mutex
+	faults     Faults
+	sessions   map[string]*session
+	nextSID    int
+	connects   []Connect
+	reconnects int
+	// latencyRequests are the timestamps RequestLatency sent, answered
+	// the ones clients echoed back.
+	latencyRequests map[uint64]bool
+	latencyAnswers  []uint64
+	// latencyProbes counts the probes clients sent
+	latencyProbes int
+}
+
+// session is one tunnel, it outlives its websocket until the client
+// or the backend closes it.
+type session struct {
+	server  *Server
+	sid     string
+	backend net.Conn
+
+	// inMu serialises relaying client data to the backend with resume,
+	// so the ack a reconnect gets covers everything written.
+	inMu sync.Mutex
+	// mu guards the rest and serialises writes to ws
+	mu sync.Mutex
+	ws *websocket.Conn
+	// wsSent is how much data went out on ws and wsAcked what the
+	// client had acked when it was resumed on ws, for Faults.DropAfter
+	wsSent   int
+	wsAcked  uint64
+	resumed  bool
+	received uint64
+	// unacked is what the client hasn't acked yet, it starts at acked
+	acked      uint64
+	unacked    []byte
+	backendEOF bool
+}
+
+// NewServer starts a server relaying to backend, a host:port.
+func NewServer(backend string) *Server {
+	s := newServer(backend)
+	s.srv.Start()
+	s.URL = "ws" + strings.TrimPrefix(s.srv.URL, "http")
+	return s
+}
+
+// NewTLSServer starts a server like NewServer behind TLS, clients have to
+// trust Certificate. It asks for a client certificate but doesn't
+// require or verify one.
+func NewTLSServer(backend string) *Server {
+	s := newServer(backend)
+	s.srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	s.srv.StartTLS()
+	s.URL = "ws" + strings.TrimPrefix(s.srv.URL, "http")
+	return s
+}
+
+func newServer(backend string) *Server {
+	s := &Server{
+		backend:  backend,
+		sessions: map[string]*session{},
+		upgrader: websocket.Upgrader{
+			Subprotocols: []string{subProtocolName},
+			CheckOrigin:  func(*http.Request) bool { return true },
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v4/connect", s.handleConnect)
+	mux.HandleFunc("/v4/reconnect", s.handleReconnect)
+	s.srv = httptest.NewUnstartedServer(mux)
+	return s
+}
+
+// Certificate returns the certificate of a TLS server.
+func (s *Server) Certificate() *x509.Certificate {
+	return s.srv.Certificate()
+}
+
+// SetFaults replaces the faults, they apply to everything sent from then on.
+func (s *Server) SetFaults(f Faults) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = f
+}
+
+// Connects returns every connect request so far.
+func (s *Server) Connects() []Connect {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Connect(nil), s.connects...)
+}
+
+// Reconnects returns how many sessions were resumed so far.
+func (s *Server) Reconnects() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reconnects
+}
+
+// Drop drops every websocket without a close frame, the sessions can
+// be resumed.
+func (s *Server) Drop() {
+	for _, sess := range s.liveSessions() {
+		sess.mu.Lock()
+		sess.dropLocked()
+		sess.mu.Unlock()
+	}
+}
+
+// Disconnect closes every websocket with code, the sessions can still be
+// resumed which is what CloseCodeReauthenticationRequired expects.
+func (s *Server) Disconnect(code int, text string) {
+	for _, sess := range s.liveSessions() {
+		sess.mu.Lock()
+		if sess.ws != nil {
+			sess.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
+			sess.dropLocked()
+		}
+		sess.mu.Unlock()
+	}
+}
+
+// RequestLatency sends every client an ACK_LATENCY probe carrying
+// timestamp, which it has to answer with a REPLY_LATENCY echoing it.
+func (s *Server) RequestLatency(timestamp uint64) {
+	s.mu.Lock()
+	if s.latencyRequests == nil {
+		s.latencyRequests = map[uint64]bool{}
+	}
+	s.latencyRequests[timestamp] = true
+	s.mu.Unlock()
+	for _, sess := range s.liveSessions() {
+		sess.mu.Lock()
+		if sess.ws != nil {
+			sess.writeLocked((&codec.AckLatencyFrame{Timestamp: timestamp}).Encode())
+		}
+		sess.mu.Unlock()
+	}
+}
+
+// LatencyProbes returns how many latency probes clients sent.
+func (s *Server) LatencyProbes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.latencyProbes
+}
+
+// LatencyAnswers returns the RequestLatency timestamps clients answered.
+func (s *Server) LatencyAnswers() []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint64(nil), s.latencyAnswers...)
+}
+
+// Close ends every session and stops the server.
+func (s *Server) Close() {
+	for _, sess := range s.liveSessions() {
+		sess.end()
+	}
+	s.srv.Close()
+}
+
+func (s *Server) liveSessions() []*session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]*session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+func (s *Server) getFaults() Faults {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.faults
+}
+
+// upgrade checks what every relay request needs and upgrades it.
+func (s *Server) upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, bool) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") || len(r.Header.Get("Authorization")) == len("Bearer ") {
+		http.Error(w, "missing bearer token", http.StatusUnauthorized)
+		return nil, false
+	}
+	if !containsString(websocket.Subprotocols(r), subProtocolName) {
+		http.Error(w, "missing subprotocol "+subProtocolName, http.StatusBadRequest)
+		return nil, false
+	}
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, false
+	}
+	return ws, true
+}
+
+func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
+	ws, ok := s.upgrade(w, r)
+	if !ok {
+		return
+	}
+	connect := Connect{Query: r.URL.Query()}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		connect.ClientCertificate = r.TLS.PeerCertificates[0]
+	}
+	s.mu.Lock()
+	s.connects = append(s.connects, connect)
+	s.nextSID++
+	sid := fmt.Sprintf("sid-%d", s.nextSID)
+	s.mu.Unlock()
+	if code := s.getFaults().RefuseConnect; code != 0 {
+		closeWith(ws, code, "refused")
+		return
+	}
+	backend, err := net.Dial("tcp", s.backend)
+	if err != nil {
+		closeWith(ws, CloseCodeFailedToConnectToBackend, err.Error())
+		return
+	}
+	sess := &session{server: s, sid: sid, backend: backend, ws: ws}
+	s.mu.Lock()
+	s.sessions[sid] = sess
+	s.mu.Unlock()
+	sess.mu.Lock()
+	err = sess.writeLocked((&codec.ConnectSuccessSidFrame{SID: sid}).Encode())
+	if err == nil && s.getFaults().BadTag {
+		err = sess.writeLocked(append([]byte{badTag >> 8, badTag & 0xff}, make([]byte, 8)...))
+	}
+	sess.mu.Unlock()
+	go sess.pumpBackend()
+	if err == nil {
+		sess.serve(ws)
+	}
+}
+
+func (s *Server) handleReconnect(w http.ResponseWriter, r *http.Request) {
+	ws, ok := s.upgrade(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	s.mu.Lock()
+	sess := s.sessions[q.Get("sid")]
+	s.mu.Unlock()
+	ack, err := strconv.ParseUint(q.Get("ack"), 10, 64)
+	if sess == nil || err != nil {
+		closeWith(ws, CloseCodeSIDUnknown, "unknown sid")
+		return
+	}
+	s.mu.Lock()
+	s.reconnects++
+	s.mu.Unlock()
+	if !sess.resume(ws, ack) {
+		return
+	}
+	sess.serve(ws)
+}
+
+// resume swaps in the new websocket and replays what the client missed,
+// it returns false if the session ended meanwhile.
+func (sess *session) resume(ws *websocket.Conn, ack uint64) bool {
+	sess.inMu.Lock()
+	defer sess.inMu.Unlock()
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.dropLocked()
+	sess.ws = ws
+	sess.ackLocked(ack)
+	sess.wsAcked = sess.acked
+	sess.resumed = true
+	err := sess.writeLocked((&codec.ReconnectSuccessAckFrame{Ack: sess.received}).Encode())
+	if err != nil {
+		return false
+	}
+	pending := sess.unacked
+	for len(pending) > 0 && sess.ws != nil {
+		n := len(pending)
+		if n > maxDataSize {
+			n = maxDataSize
+		}
+		sess.sendDataLocked(pending[:n])
+		pending = pending[n:]
+	}
+	if sess.backendEOF && sess.ws != nil {
+		sess.closeLocked()
+		return false
+	}
+	return sess.ws != nil
+}
+
+// serve reads the frames the client sends on ws until it drops or closes.
+func (sess *session) serve(ws *websocket.Conn) {
+	decoder := codec.NewDecoder()
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				sess.end()
+				return
+			}
+			// a drop, the session waits for a reconnect
+			sess.mu.Lock()
+			if sess.ws == ws {
+				sess.dropLocked()
+			}
+			sess.mu.Unlock()
+			return
+		}
+		decoder.Write(msg)
+		for {
+			frame, err := decoder.NextFrame()
+			if err != nil {
+				closeWith(ws, websocket.CloseProtocolError, err.Error())
+				sess.end()
+				return
+			}
+			if frame == nil {
+				break
+			}
+			err = sess.handleFrame(ws, frame)
+			if err != nil {
+				sess.end()
+				return
+			}
+		}
+	}
+}
+
+// handleFrame handles a frame read off of ws, frames still coming in on
+// a websocket that was replaced are ignored since the client replays them.
+func (sess *session) handleFrame(ws *websocket.Conn, frame codec.Frame) error {
+	switch f := frame.(type) {
+	case *codec.DataFrame:
+		sess.inMu.Lock()
+		defer sess.inMu.Unlock()
+		if !sess.isCurrent(ws) {
+			return nil
+		}
+		_, err := sess.backend.Write(f.Data)
+		if err != nil {
+			return err
+		}
+		sess.mu.Lock()
+		defer sess.mu.Unlock()
+		sess.received += uint64(len(f.Data))
+		if sess.ws != ws {
+			return nil
+		}
+		return sess.writeLocked((&codec.AckFrame{Ack: sess.received}).Encode())
+	case *codec.AckFrame:
+		sess.mu.Lock()
+		sess.ackLocked(f.Ack)
+		sess.mu.Unlock()
+	case *codec.ReplyLatencyFrame:
+		// replies to anything but RequestLatency are ignored like IAP does
+		s := sess.server
+		s.mu.Lock()
+		if s.latencyRequests[f.Timestamp] {
+			s.latencyAnswers = append(s.latencyAnswers, f.Timestamp)
+		}
+		s.mu.Unlock()
+	case *codec.AckLatencyFrame:
+		s := sess.server
+		s.mu.Lock()
+		s.latencyProbes++
+		s.mu.Unlock()
+		sess.mu.Lock()
+		defer sess.mu.Unlock()
+		if sess.ws != ws {
+			return nil
+		}
+		return sess.writeLocked((&codec.ReplyLatencyFrame{Timestamp: f.Timestamp}).Encode())
+	}
+	return nil
+}
+
+func (sess *session) isCurrent(ws *websocket.Conn) bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.ws == ws
+}
+
+// pumpBackend relays what the backend sends until it closes, then ends
+// the websocket the way the relay does.
+func (sess *session) pumpBackend() {
+	buf := make([]byte, maxDataSize)
+	for {
+		n, err := sess.backend.Read(buf)
+		sess.mu.Lock()
+		if n > 0 {
+			data := append([]byte(nil), buf[:n]...)
+			sess.unacked = append(sess.unacked, data...)
+			if sess.ws != nil {
+				sess.sendDataLocked(data)
+			}
+		}
+		if err != nil {
+			sess.backendEOF = true
+			if sess.ws != nil {
+				sess.closeLocked()
+			}
+			sess.mu.Unlock()
+			return
+		}
+		sess.mu.Unlock()
+	}
+}
+
+// sendDataLocked sends data, which is already in unacked, unless
+// Faults.DropAfter says to drop the websocket first. Dropping loses
+// whatever is in flight, so a resumed session is only dropped again
+// once the client acked something on the new websocket.
+func (sess *session) sendDataLocked(data []byte) {
+	dropAfter := sess.server.getFaults().DropAfter
+	progressed := !sess.resumed || sess.acked > sess.wsAcked
+	if dropAfter > 0 && sess.wsSent > 0 && progressed && sess.wsSent+len(data) > dropAfter {
+		sess.dropLocked()
+		return
+	}
+	sess.wsSent += len(data)
+	err := sess.writeLocked((&codec.DataFrame{Data: data}).Encode())
+	if err != nil {
+		sess.dropLocked()
+	}
+}
+
+// writeLocked writes one frame with the faults applied.
+func (sess *session) writeLocked(frame []byte) error {
+	faults := sess.server.getFaults()
+	messages := [][]byte{frame}
+	if faults.SplitFrames && len(frame) > 1 {
+		messages = [][]byte{frame[:len(frame)/2], frame[len(frame)/2:]}
+	}
+	for _, msg := range messages {
+		if faults.Delay > 0 {
+			time.Sleep(faults.Delay)
+		}
+		err := sess.ws.WriteMessage(websocket.BinaryMessage, msg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sess *session) ackLocked(ack uint64) {
+	if ack <= sess.acked || ack > sess.acked+uint64(len(sess.unacked)) {
+		return
+	}
+	sess.unacked = sess.unacked[ack-sess.acked:]
+	sess.acked = ack
+}
+
+// dropLocked closes the websocket without a close frame.
+func (sess *session) dropLocked() {
+	if sess.ws == nil {
+		return
+	}
+	sess.ws.Close()
+	sess.ws = nil
+	sess.wsSent = 0
+}
+
+// closeLocked closes the websocket normally and forgets the session.
+func (sess *session) closeLocked() {
+	closeWith(sess.ws, websocket.CloseNormalClosure, "")
+	sess.ws = nil
+	sess.forget()
+}
+
+// end closes the session from either side.
+func (sess *session) end() {
+	sess.mu.Lock()
+	sess.dropLocked()
+	sess.mu.Unlock()
+	sess.backend.Close()
+	sess.forget()
+}
+
+func (sess *session) forget() {
+	sess.server.mu.Lock()
+	delete(sess.server.sessions, sess.sid)
+	sess.server.mu.Unlock()
+}
+
+func closeWith(ws *websocket.Conn, code int, text string) {
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
+	ws.Close()
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
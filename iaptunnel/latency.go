@@ -0,0 +1,85 @@
+package iaptunnel
+
+import (
+	"github.com/eahrend/gcp-iap-tunnel-parser/iaptunnel/codec"
+	"sync/atomic"
+	"time"
+)
+
+// Latency probes are ACK_LATENCY frames whose timestamp the other end
+// echoes back in a REPLY_LATENCY, both IAP and the client send them.
+// Replies are never answered, so a late or duplicate one can't start
+// the two ends bouncing it back and forth. Our own probes carry
+// nanoseconds since the Conn started, so they're monotonic and can't be
+// confused with wall clock time.
+
+// maxOutstandingProbes bounds the probes waiting for an answer, the
+// oldest is forgotten when IAP doesn't answer it.
+const maxOutstandingProbes = 16
+
+// probeLatency sends a probe every interval until the tunnel stops.
+func (c *Conn) probeLatency(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := c.sendLatencyProbe()
+			if err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Conn) sendLatencyProbe() error {
+	c.sendMu.Lock()
+	reconnecting := c.reconnecting
+	c.sendMu.Unlock()
+	if reconnecting {
+		return nil
+	}
+	timestamp := uint64(time.Since(c.start))
+	c.probesMu.Lock()
+	if len(c.probes) == maxOutstandingProbes {
+		c.probes = append(c.probes[:0], c.probes[1:]...)
+	}
+	c.probes = append(c.probes, timestamp)
+	c.probesMu.Unlock()
+	probe := &codec.AckLatencyFrame{Timestamp: timestamp}
+	return c.writeFrame(probe.Encode(), time.Time{})
+}
+
+// answerLatencyProbe echoes a probe sent by IAP.
+func (c *Conn) answerLatencyProbe(f *codec.AckLatencyFrame) error {
+	reply := &codec.ReplyLatencyFrame{Timestamp: f.Timestamp}
+	return c.writeFrame(reply.Encode(), time.Time{})
+}
+
+// handleLatencyReply records the round trip when f answers one of our
+// outstanding probes, a stale or duplicate reply is ignored.
+func (c *Conn) handleLatencyReply(f *codec.ReplyLatencyFrame) {
+	c.probesMu.Lock()
+	ours := false
+	for i, timestamp := range c.probes {
+		if timestamp == f.Timestamp {
+			c.probes = append(c.probes[:i], c.probes[i+1:]...)
+			ours = true
+			break
+		}
+	}
+	c.probesMu.Unlock()
+	if !ours {
+		return
+	}
+	rtt := time.Since(c.start) - time.Duration(f.Timestamp)
+	atomic.StoreInt64(&c.latency, int64(rtt))
+}
+
+// Latency returns the round trip time to IAP measured by the last
+// answered latency probe, zero until one has been answered.
+func (c *Conn) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.latency))
+}
@@ -0,0 +1,234 @@
+package iaptunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// loopbackAddresses are what localhost binds, so clients get through
+// whichever one they resolve it to.
+var loopbackAddresses = []string{"127.0.0.1", "::1"}
+
+// how many times a port picked for 127.0.0.1 is tried on ::1 too
+const maxPickPortAttempts = 5
+
+// listen is net.Listen, tests make it fail
+var listen = net.Listen
+
+// link is os.Link, tests create the socket's path in the meantime
+var link = os.Link
+
+// listenTCP listens on host and port. localhost, or no host at all,
+// listens on every loopback address that's available with the same
+// port. Other hosts have to be IP addresses, and loopback ones unless
+// allowNonLoopback is set.
+func listenTCP(host, port string, allowNonLoopback bool) (net.Listener, error) {
+	if host == "" || host == "localhost" {
+		return listenLocalhost(port)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("local host %q has to be localhost or an IP address", host)
+	}
+	if !ip.IsLoopback() && !allowNonLoopback {
+		return nil, fmt.Errorf("%w: %s", ErrNonLoopback, host)
+	}
+	return listen("tcp", net.JoinHostPort(ip.String(), port))
+}
+
+func listenLocalhost(port string) (net.Listener, error) {
+	for attempt := 1; ; attempt++ {
+		listeners, err := listenLoopbacks(port)
+		if err == nil {
+			if len(listeners) == 1 {
+				return listeners[0], nil
+			}
+			return newMultiListener(listeners), nil
+		}
+		// the port picked for 127.0.0.1 can be taken on ::1
+		if (port != "" && port != "0") || !errors.Is(err, syscall.EADDRINUSE) || attempt == maxPickPortAttempts {
+			return nil, err
+		}
+	}
+}
+
+// listenLoopbacks listens on the loopback addresses, skipping the
+// ones whose address family isn't there like ::1 without IPv6.
+func listenLoopbacks(port string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	var skipped error
+	for _, address := range loopbackAddresses {
+		l, err := listen("tcp", net.JoinHostPort(address, port))
+		if errors.Is(err, syscall.EADDRINUSE) {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		if err != nil {
+			if skipped == nil {
+				skipped = err
+			}
+			continue
+		}
+		listeners = append(listeners, l)
+		// a picked port has to be the same on every address
+		_, port, _ = net.SplitHostPort(l.Addr().String())
+	}
+	if len(listeners) == 0 {
+		return nil, skipped
+	}
+	return listeners, nil
+}
+
+// unixListener removes its socket file once it's closed.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// Addr returns path rather than the temporary name the socket was
+// created under.
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+// listenUnix listens on a unix socket at path, with mode and owned by
+// uid and gid, -1 leaves those as they are. The socket is set up in a
+// private directory and only linked to path once its mode and owner are
+// set, nobody can connect before. A socket left behind by a process
+// that's gone is replaced, anything created at path since is kept.
+func listenUnix(path string, mode os.FileMode, uid, gid int) (net.Listener, error) {
+	err := removeStaleSocket(path)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmpPath := filepath.Join(dir, "socket")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false)
+	err = os.Chmod(tmpPath, mode)
+	if err == nil && (uid != -1 || gid != -1) {
+		err = os.Chown(tmpPath, uid, gid)
+	}
+	if err == nil {
+		// unlike renaming, linking fails rather than replace what's there
+		err = link(tmpPath, path)
+		if errors.Is(err, os.ErrExist) {
+			err = fmt.Errorf("%s was created while setting up the socket", path)
+		}
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: l, path: path}, nil
+}
+
+// removeStaleSocket removes the socket at path if nothing is listening
+// on it anymore.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+	return os.Remove(path)
+}
+
+// multiListener accepts clients from several listeners at once,
+// its address is the one of the first listener.
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	m := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult),
+		closed:    make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go m.acceptLoop(l)
+	}
+	return m
+}
+
+func (m *multiListener) acceptLoop(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		select {
+		case m.accepted <- acceptResult{conn, err}:
+		case <-m.closed:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-m.accepted:
+		return r.conn, r.err
+	case <-m.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	err := net.ErrClosed
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		errs := make([]error, len(m.listeners))
+		for i, l := range m.listeners {
+			errs[i] = l.Close()
+		}
+		err = errors.Join(errs...)
+	})
+	return err
+}
+
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
@@ -0,0 +1,247 @@
+package iaptunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestListenTCP(t *testing.T) {
+	tests := []struct {
+		name             string
+		host             string
+		allowNonLoopback bool
+		wantErr          error
+	}{
+		{"default", "", false, nil},
+		{"localhost", "localhost", false, nil},
+		{"loopback ip", "127.0.0.1", false, nil},
+		{"non-loopback", "0.0.0.0", false, ErrNonLoopback},
+		{"non-loopback allowed", "0.0.0.0", true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := listenTCP(tt.host, "0", tt.allowNonLoopback)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("listenTCP(%q) = %v, want %v", tt.host, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer l.Close()
+			ip := l.Addr().(*net.TCPAddr).IP
+			if !tt.allowNonLoopback && !ip.IsLoopback() {
+				t.Errorf("listening on %s, want a loopback address", ip)
+			}
+		})
+	}
+	_, err := listenTCP("example.com", "0", true)
+	if err == nil {
+		t.Error("listening on a host name, want only IP addresses allowed")
+	}
+}
+
+func TestNewOrcaNonLoopback(t *testing.T) {
+	// the tunnel has no credentials, the local side has to fail first
+	_, err := NewOrca(context.Background(),
+		WithTunnelConnectionOptions(WithProject("test-project"), WithInstanceName("test-instance")),
+		WithLocalConnOptions(WithLocalConnHost("192.0.2.1"), WithLocalConnPort("0")))
+	if !errors.Is(err, ErrNonLoopback) {
+		t.Errorf("NewOrca = %v, want ErrNonLoopback", err)
+	}
+}
+
+func TestListenLocalhostDualStack(t *testing.T) {
+	l, err := listenLocalhost("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	m, ok := l.(*multiListener)
+	if !ok {
+		t.Skip("no IPv6 loopback")
+	}
+	port := m.listeners[0].Addr().(*net.TCPAddr).Port
+	for _, l := range m.listeners {
+		addr := l.Addr().(*net.TCPAddr)
+		if addr.Port != port {
+			t.Errorf("%s listens on port %d, want %d like the others", addr.IP, addr.Port, port)
+		}
+		c, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Errorf("dialing %s: %v", addr, err)
+			continue
+		}
+		c.Close()
+	}
+}
+
+// failIPv6 makes listening on ::1 fail with EADDRINUSE the first fails
+// times, it returns how many times ::1 was tried.
+func failIPv6(t *testing.T, fails int) *int {
+	attempts := 0
+	listen = func(network, address string) (net.Listener, error) {
+		host, _, _ := net.SplitHostPort(address)
+		if host == "::1" {
+			attempts++
+			if attempts <= fails {
+				return nil, fmt.Errorf("listen %s: %w", address, syscall.EADDRINUSE)
+			}
+		}
+		return net.Listen(network, address)
+	}
+	t.Cleanup(func() { listen = net.Listen })
+	return &attempts
+}
+
+func TestListenLocalhostRetry(t *testing.T) {
+	tests := []struct {
+		name string
+		// givenPort asks for a free port rather than having one picked
+		givenPort    bool
+		fails        int
+		wantErr      bool
+		wantAttempts int
+	}{
+		{"picked port taken once", false, 1, false, 2},
+		{"picked port always taken", false, maxPickPortAttempts, true, maxPickPortAttempts},
+		{"given port taken", true, 1, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := "0"
+			if tt.givenPort {
+				l, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, port, _ = net.SplitHostPort(l.Addr().String())
+				l.Close()
+			}
+			attempts := failIPv6(t, tt.fails)
+			l, err := listenLocalhost(port)
+			if err == nil {
+				l.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("listenLocalhost = %v, want an error %t", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, syscall.EADDRINUSE) {
+				t.Errorf("listenLocalhost = %v, want EADDRINUSE", err)
+			}
+			if *attempts != tt.wantAttempts {
+				t.Errorf("::1 tried %d times, want %d", *attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel.sock")
+	// root can give the socket away, anyone else only to themselves
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid == 0 {
+		uid, gid = 1, 1
+	}
+	l, err := listenUnix(path, 0640, uid, gid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0640 {
+		t.Errorf("socket mode %s, want a socket with 0640", info.Mode())
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	if int(stat.Uid) != uid || int(stat.Gid) != gid {
+		t.Errorf("socket owned by %d:%d, want %d:%d", stat.Uid, stat.Gid, uid, gid)
+	}
+	if l.Addr().String() != path {
+		t.Errorf("Addr = %s, want %s", l.Addr(), path)
+	}
+	// a live socket isn't taken over
+	_, err = listenUnix(path, 0600, -1, -1)
+	if err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Errorf("listening on a live socket = %v, want it refused", err)
+	}
+	l.Close()
+	_, err = os.Lstat(path)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("socket left behind after Close: %v", err)
+	}
+}
+
+func TestListenUnixStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel.sock")
+	// a socket whose listener went away without removing it
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	l, err := listenUnix(path, 0600, -1, -1)
+	if err != nil {
+		t.Fatalf("listening over a stale socket: %v", err)
+	}
+	defer l.Close()
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestListenUnixNotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel.sock")
+	err := os.WriteFile(path, []byte("keep me"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = listenUnix(path, 0600, -1, -1)
+	if err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("listening over a file = %v, want it refused", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil || string(got) != "keep me" {
+		t.Errorf("the file was touched: %q, %v", got, err)
+	}
+}
+
+func TestListenUnixCreatedMeanwhile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tunnel.sock")
+	// something takes path after the stale socket check
+	link = func(oldname, newname string) error {
+		info, err := os.Stat(filepath.Dir(oldname))
+		if err != nil || info.Mode().Perm() != 0700 {
+			t.Errorf("socket set up in %v, %v, want a private directory", info, err)
+		}
+		err = os.WriteFile(newname, []byte("keep me"), 0600)
+		if err != nil {
+			return err
+		}
+		return os.Link(oldname, newname)
+	}
+	t.Cleanup(func() { link = os.Link })
+	_, err := listenUnix(path, 0600, -1, -1)
+	if err == nil || !strings.Contains(err.Error(), "was created while") {
+		t.Errorf("listenUnix = %v, want it to leave the new file alone", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil || string(got) != "keep me" {
+		t.Errorf("the file was replaced: %q, %v", got, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("left in the directory: %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,181 @@
+package iaptunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// LocalConn represents the local tcp listener, every accepted
+// client gets its own tunnel. With both a reader and a writer
+// set it doesn't listen, the reader and writer are the only client.
+type LocalConn struct {
+	localListener net.Listener
+	host          string
+	port          string
+	// allowNonLoopback lets host be an address other users
+	// or machines can reach.
+	allowNonLoopback bool
+	// unixSocket is listened on instead of host and port when set
+	unixSocket     string
+	unixSocketMode os.FileMode
+	unixSocketUID  int
+	unixSocketGID  int
+	reader         io.Reader
+	writer         io.Writer
+	// pipe is the client made of reader and writer
+	pipe         *pipeConn
+	pipeMu       sync.Mutex
+	pipeAccepted bool
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+// LocalConnOption is the configuration option for LocalConn
+// used in the constructor.
+type LocalConnOption func(conn *LocalConn)
+
+// only the user running the tunnel can connect by default
+const defaultUnixSocketMode os.FileMode = 0600
+
+func NewLocalConn(ctx context.Context, opts ...LocalConnOption) (*LocalConn, error) {
+	lc := &LocalConn{
+		closed:         make(chan struct{}),
+		unixSocketMode: defaultUnixSocketMode,
+		unixSocketUID:  -1,
+		unixSocketGID:  -1,
+	}
+	for _, opt := range opts {
+		opt(lc)
+	}
+	if lc.reader != nil && lc.writer != nil {
+		lc.pipe = newPipeConn(lc.reader, lc.writer)
+		return lc, nil
+	}
+	var localListener net.Listener
+	var err error
+	if lc.unixSocket != "" {
+		localListener, err = listenUnix(lc.unixSocket, lc.unixSocketMode, lc.unixSocketUID, lc.unixSocketGID)
+	} else {
+		// an empty or 0 port has the OS pick an unused one, Addr says which
+		localListener, err = listenTCP(lc.host, lc.port, lc.allowNonLoopback)
+	}
+	if err != nil {
+		return nil, err
+	}
+	lc.localListener = localListener
+	return lc, nil
+}
+
+// WithLocalConnHost sets the address to listen on, localhost by default
+// which listens on both 127.0.0.1 and ::1. Anything else has to be an
+// IP address.
+func WithLocalConnHost(host string) LocalConnOption {
+	return func(conn *LocalConn) {
+		conn.host = host
+	}
+}
+
+// WithLocalConnAllowNonLoopback allows listening on addresses that
+// aren't loopback ones, which exposes the tunnel beyond this machine.
+func WithLocalConnAllowNonLoopback(allow bool) LocalConnOption {
+	return func(conn *LocalConn) {
+		conn.allowNonLoopback = allow
+	}
+}
+
+func WithLocalConnPort(port string) LocalConnOption {
+	return func(conn *LocalConn) {
+		conn.port = port
+	}
+}
+
+// WithLocalConnUnixSocket listens on a unix socket at path instead of
+// a TCP port, mode sets who can connect to it.
+func WithLocalConnUnixSocket(path string, mode os.FileMode) LocalConnOption {
+	return func(conn *LocalConn) {
+		conn.unixSocket = path
+		conn.unixSocketMode = mode
+	}
+}
+
+// WithLocalConnUnixSocketOwner sets the owner and group of the unix
+// socket, -1 leaves either one as it is.
+func WithLocalConnUnixSocketOwner(uid, gid int) LocalConnOption {
+	return func(conn *LocalConn) {
+		conn.unixSocketUID = uid
+		conn.unixSocketGID = gid
+	}
+}
+
+// WithLocalConnStdio makes stdin and stdout the only client, the way
+// gcloud's --listen-on-stdin does.
+func WithLocalConnStdio() LocalConnOption {
+	return func(conn *LocalConn) {
+		conn.reader = os.Stdin
+		conn.writer = os.Stdout
+	}
+}
+
+func WithLocalConnWriter(writer io.Writer) LocalConnOption {
+	return func(conn *LocalConn) {
+		conn.writer = writer
+	}
+}
+
+func WithLocalConnReader(reader io.Reader) LocalConnOption {
+	return func(conn *LocalConn) {
+		conn.reader = reader
+	}
+}
+
+// Accept is blocking, only start accepting once we can confirm that
+// the websocket connection is valid. Without a listener the reader and
+// writer are returned once, after that Accept waits for them to be
+// closed and returns io.EOF.
+func (lc *LocalConn) Accept() (net.Conn, error) {
+	if lc.localListener != nil {
+		return lc.localListener.Accept()
+	}
+	if isClosedChan(lc.closed) {
+		return nil, net.ErrClosed
+	}
+	lc.pipeMu.Lock()
+	accepted := lc.pipeAccepted
+	lc.pipeAccepted = true
+	lc.pipeMu.Unlock()
+	if !accepted {
+		return lc.pipe, nil
+	}
+	select {
+	case <-lc.pipe.closed:
+		return nil, io.EOF
+	case <-lc.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Addr returns the address clients connect to, including the port
+// that was picked if none was asked for.
+func (lc *LocalConn) Addr() net.Addr {
+	if lc.localListener == nil {
+		return pipeAddr{}
+	}
+	return lc.localListener.Addr()
+}
+
+// Close stops the listener, clients that were already accepted
+// stay open.
+func (lc *LocalConn) Close() error {
+	if lc.localListener != nil {
+		return lc.localListener.Close()
+	}
+	err := net.ErrClosed
+	lc.closeOnce.Do(func() {
+		close(lc.closed)
+		err = nil
+	})
+	return err
+}
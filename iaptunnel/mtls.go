@@ -0,0 +1,181 @@
+package iaptunnel
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// MTLSPolicy says when the mTLS endpoint is used, it needs a client
+// certificate which BeyondCorp certificate based access checks.
+type MTLSPolicy int
+
+const (
+	// MTLSNever always dials the TLS endpoint.
+	MTLSNever MTLSPolicy = iota
+	// MTLSAuto dials the mTLS endpoint when a client certificate is
+	// available and falls back to the TLS endpoint when there is no
+	// source, it fails to produce one or the mTLS endpoint can't be
+	// reached. Falling back is logged, see WithTunnelLogWriter.
+	MTLSAuto
+	// MTLSAlways dials the mTLS endpoint and fails without a client
+	// certificate, for when access levels require one. Dial failures
+	// are an MTLSError.
+	MTLSAlways
+)
+
+// ErrNoClientCertificate is returned when MTLSAlways is set without a
+// client certificate source.
+var ErrNoClientCertificate = errors.New("mTLS is required but there is no client certificate")
+
+// ParseMTLSPolicy parses never, auto or always.
+func ParseMTLSPolicy(s string) (MTLSPolicy, error) {
+	switch s {
+	case "never", "":
+		return MTLSNever, nil
+	case "auto":
+		return MTLSAuto, nil
+	case "always":
+		return MTLSAlways, nil
+	}
+	return MTLSNever, fmt.Errorf("unknown mTLS policy %q, expected never, auto or always", s)
+}
+
+func (p MTLSPolicy) String() string {
+	switch p {
+	case MTLSAuto:
+		return "auto"
+	case MTLSAlways:
+		return "always"
+	}
+	return "never"
+}
+
+// ClientCertificateSource returns the client certificate presented to
+// the mTLS endpoint, it has the signature of tls.Config.GetClientCertificate.
+type ClientCertificateSource func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+
+// PEMCertificateSource loads the certificate chain and key from PEM files.
+func PEMCertificateSource(certFile, keyFile string) (ClientCertificateSource, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return staticCertificateSource(&cert), nil
+}
+
+// SignerCertificateSource presents chain, DER encoded leaf first, and
+// signs the handshake with signer. This is how keys that never leave a
+// PKCS#11 token or an enterprise certificate provider are used.
+func SignerCertificateSource(chain [][]byte, signer crypto.Signer) ClientCertificateSource {
+	return staticCertificateSource(&tls.Certificate{
+		Certificate: chain,
+		PrivateKey:  signer,
+	})
+}
+
+func staticCertificateSource(cert *tls.Certificate) ClientCertificateSource {
+	return func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return cert, nil
+	}
+}
+
+// SecureConnectCertificateSource uses the device certificate of Endpoint
+// Verification. Its provider command, configured in
+// ~/.secureConnect/context_aware_metadata.json, prints the certificate
+// and key as PEM. The command is run on the first handshake and again
+// after it failed, so a device enrolled later is picked up.
+func SecureConnectCertificateSource() ClientCertificateSource {
+	var mu sync.Mutex
+	var cert *tls.Certificate
+	return func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if cert != nil {
+			return cert, nil
+		}
+		c, err := runCertificateProvider(cri.Context())
+		if err != nil {
+			return nil, err
+		}
+		cert = c
+		return cert, nil
+	}
+}
+
+func runCertificateProvider(ctx context.Context) (*tls.Certificate, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(home, ".secureConnect", "context_aware_metadata.json"))
+	if err != nil {
+		return nil, err
+	}
+	var metadata struct {
+		Command []string `json:"cert_provider_command"`
+	}
+	err = json.Unmarshal(data, &metadata)
+	if err != nil {
+		return nil, err
+	}
+	if len(metadata.Command) == 0 {
+		return nil, errors.New("context aware metadata has no cert_provider_command")
+	}
+	out, err := exec.CommandContext(ctx, metadata.Command[0], metadata.Command[1:]...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("running certificate provider: %w", err)
+	}
+	// the output holds both the certificate and the key blocks
+	cert, err := tls.X509KeyPair(out, out)
+	if err != nil {
+		return nil, fmt.Errorf("certificate provider output: %w", err)
+	}
+	return &cert, nil
+}
+
+// mtlsResult decides how a dial of the mTLS endpoint ends under policy,
+// certErr is what getting the client certificate failed with and err what
+// the dial did. It reports whether to dial the TLS endpoint instead.
+// MTLSAuto falls back on anything but IAP refusing the credentials or
+// the dial being cancelled, MTLSAlways returns an MTLSError.
+func mtlsResult(policy MTLSPolicy, certErr, err error) (bool, error) {
+	var authErr *AuthError
+	switch {
+	case certErr != nil && policy == MTLSAlways:
+		return false, &AuthError{Err: fmt.Errorf("getting client certificate: %w", certErr)}
+	case certErr != nil:
+		// MTLSAuto carries on without a certificate
+		return true, nil
+	case err == nil:
+		return false, nil
+	case errors.As(err, &authErr), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		// the TLS endpoint wouldn't do any better
+		return false, err
+	case policy == MTLSAlways:
+		return false, &MTLSError{Err: err}
+	}
+	return true, nil
+}
+
+// WithMTLSPolicy sets when the mTLS endpoint is dialed, MTLSNever by default.
+func WithMTLSPolicy(policy MTLSPolicy) TunnelConnectionOption {
+	return func(tc *TunnelConnection) {
+		tc.mtlsPolicy = policy
+	}
+}
+
+// WithClientCertificateSource sets the client certificate presented to
+// the mTLS endpoint.
+func WithClientCertificateSource(source ClientCertificateSource) TunnelConnectionOption {
+	return func(tc *TunnelConnection) {
+		tc.clientCertificate = source
+	}
+}
@@ -0,0 +1,60 @@
+package iaptunnel
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestParseMTLSPolicy(t *testing.T) {
+	for _, policy := range []MTLSPolicy{MTLSNever, MTLSAuto, MTLSAlways} {
+		got, err := ParseMTLSPolicy(policy.String())
+		if err != nil || got != policy {
+			t.Errorf("ParseMTLSPolicy(%q) = %v, %v", policy, got, err)
+		}
+	}
+	if _, err := ParseMTLSPolicy("sometimes"); err == nil {
+		t.Error("parsed an unknown policy")
+	}
+}
+
+func TestMTLSResult(t *testing.T) {
+	noCert := errors.New("no certificate on this device")
+	refused := errors.New("connection refused")
+	forbidden := &AuthError{Err: errors.New("403 Forbidden")}
+	for _, tc := range []struct {
+		name         string
+		policy       MTLSPolicy
+		certErr, err error
+		wantFallback bool
+		wantErr      error
+	}{
+		{"auto", MTLSAuto, nil, nil, false, nil},
+		{"auto falls back", MTLSAuto, noCert, refused, true, nil},
+		{"auto dial fails", MTLSAuto, nil, refused, true, nil},
+		{"auto not authorized", MTLSAuto, nil, forbidden, false, forbidden},
+		{"auto cancelled", MTLSAuto, nil, context.Canceled, false, context.Canceled},
+		{"always", MTLSAlways, nil, nil, false, nil},
+		{"always fails", MTLSAlways, noCert, refused, false, noCert},
+		{"always dial fails", MTLSAlways, nil, refused, false, refused},
+		{"always not authorized", MTLSAlways, nil, forbidden, false, forbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fallback, err := mtlsResult(tc.policy, tc.certErr, tc.err)
+			if fallback != tc.wantFallback || !errors.Is(err, tc.wantErr) {
+				t.Fatalf("mtlsResult = %v, %v, want %v, %v", fallback, err, tc.wantFallback, tc.wantErr)
+			}
+			var authErr *AuthError
+			if tc.certErr != nil && err != nil && !errors.As(err, &authErr) {
+				t.Errorf("certificate error %v isn't an AuthError", err)
+			}
+			var mtlsErr *MTLSError
+			if tc.policy == MTLSAlways && tc.certErr == nil && tc.err == refused && !errors.As(err, &mtlsErr) {
+				t.Errorf("dial error %v isn't an MTLSError", err)
+			}
+		})
+	}
+	if _, err := NewTunnelConnection(context.Background(), WithMTLSPolicy(MTLSAlways)); !errors.Is(err, ErrNoClientCertificate) {
+		t.Errorf("MTLSAlways without a source = %v, want ErrNoClientCertificate", err)
+	}
+}
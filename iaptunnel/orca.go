@@ -0,0 +1,376 @@
+package iaptunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Orca handles the communication between the
+// local port and the proxy port
+type Orca struct {
+	// tunnelConn is the verified target, every client
+	// connection opens a new session off of it.
+	tunnelConn    *TunnelConnection
+	localConn     *LocalConn
+	tunnelOpts    []TunnelConnectionOption
+	localOpts     []LocalConnOption
+	drainTimeout  time.Duration
+	clientErrors  func(client net.Addr, err error)
+	log           io.Writer
+	connectionsMu sync.Mutex
+	connections   []*clientConnection
+	shuttingDown  bool
+}
+
+// clientConnection pairs an accepted local client with its tunnel.
+type clientConnection struct {
+	local  net.Conn
+	tunnel *Conn
+	done   chan struct{}
+	// err is what went wrong with a client that ended during
+	// shutdown, set before done is closed.
+	err error
+}
+
+const defaultDrainTimeout = 5 * time.Second
+
+// OrcaOption is the configuration option for Orca
+// used in the constructor.
+type OrcaOption func(orca *Orca)
+
+// NewOrca creates the tunnel and local connections from the options
+// passed through WithTunnelConnectionOptions and WithLocalConnOptions.
+func NewOrca(ctx context.Context, opts ...OrcaOption) (*Orca, error) {
+	orca := &Orca{
+		drainTimeout: defaultDrainTimeout,
+		log:          os.Stderr,
+	}
+	orca.clientErrors = func(client net.Addr, err error) {
+		fmt.Fprintf(orca.log, "Client %s failed: %v\n", client, err)
+	}
+	for _, opt := range opts {
+		opt(orca)
+	}
+	// the local side first, a mistake there shouldn't wait on or be
+	// hidden by looking the instance up
+	lc, err := NewLocalConn(ctx, orca.localOpts...)
+	if err != nil {
+		return nil, err
+	}
+	// the tunnel logs to the same place unless told otherwise
+	tunnelOpts := append([]TunnelConnectionOption{WithTunnelLogWriter(orca.log)}, orca.tunnelOpts...)
+	tc, err := NewTunnelConnection(ctx, tunnelOpts...)
+	if err != nil {
+		lc.Close()
+		return nil, err
+	}
+	orca.tunnelConn = tc
+	orca.localConn = lc
+	return orca, nil
+}
+
+// WithTunnelConnectionOptions sets the options used to create the tunnel connection
+func WithTunnelConnectionOptions(opts ...TunnelConnectionOption) OrcaOption {
+	return func(orca *Orca) {
+		orca.tunnelOpts = append(orca.tunnelOpts, opts...)
+	}
+}
+
+// WithLocalConnOptions sets the options used to create the local connection
+func WithLocalConnOptions(opts ...LocalConnOption) OrcaOption {
+	return func(orca *Orca) {
+		orca.localOpts = append(orca.localOpts, opts...)
+	}
+}
+
+// WithDrainTimeout sets how long a closing client waits for IAP to
+// ack the data it sent, during shutdown too.
+func WithDrainTimeout(timeout time.Duration) OrcaOption {
+	return func(orca *Orca) {
+		orca.drainTimeout = timeout
+	}
+}
+
+// WithClientErrorHandler sets what's called with the error of every
+// client that fails while Orca is serving, by default it's printed.
+// Errors of clients still around at shutdown are returned by Run.
+func WithClientErrorHandler(handler func(client net.Addr, err error)) OrcaOption {
+	return func(orca *Orca) {
+		orca.clientErrors = handler
+	}
+}
+
+// WithLogWriter sets where Orca writes what it's doing, stderr by default.
+func WithLogWriter(w io.Writer) OrcaOption {
+	return func(orca *Orca) {
+		orca.log = w
+	}
+}
+
+// Run accepts local clients until ctx is cancelled, each client is
+// tunneled over its own websocket. When the local connection is a
+// reader and writer Run returns once that one client is done. On the
+// way out the clients are drained and the returned error joins
+// everything that failed.
+func (orca *Orca) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	switch addr := orca.Addr().(type) {
+	case *net.UnixAddr:
+		fmt.Fprintf(orca.log, "Listening on %s\n", addr.Name)
+	case *net.TCPAddr:
+		fmt.Fprintf(orca.log, "Listening on port %d\n", addr.Port)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			err := orca.acceptNewConnection(ctx)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			// same as gcloud, erase the reference of dead connections
+			orca.cleanDeadClientConnections()
+		}
+	}()
+	var errs []error
+	select {
+	case <-ctx.Done():
+	case err := <-errCh:
+		// io.EOF is the only client being done
+		if err != io.EOF {
+			errs = append(errs, fmt.Errorf("accepting clients: %w", err))
+		}
+	}
+	orca.connectionsMu.Lock()
+	orca.shuttingDown = true
+	orca.connectionsMu.Unlock()
+	err := orca.localConn.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		errs = append(errs, fmt.Errorf("closing listener: %w", err))
+	}
+	// stop any tunnels still being dialed
+	cancel()
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), orca.drainTimeout)
+	defer cancelDrain()
+	errs = append(errs, orca.closeClientConnections(drainCtx))
+	fmt.Fprintln(orca.log, "Server shutdown complete.")
+	return errors.Join(errs...)
+}
+
+// Addr returns the address local clients connect to.
+func (orca *Orca) Addr() net.Addr {
+	return orca.localConn.Addr()
+}
+
+// acceptNewConnection waits for a local client and starts tunneling it
+// in the background.
+func (orca *Orca) acceptNewConnection(ctx context.Context) error {
+	local, err := orca.localConn.Accept()
+	if err != nil {
+		return err
+	}
+	cc := &clientConnection{
+		local: local,
+		done:  make(chan struct{}),
+	}
+	orca.connectionsMu.Lock()
+	defer orca.connectionsMu.Unlock()
+	if orca.shuttingDown {
+		return local.Close()
+	}
+	fmt.Fprintf(orca.log, "Client connected: %s\n", local.RemoteAddr())
+	orca.connections = append(orca.connections, cc)
+	go orca.handleClient(ctx, cc)
+	return nil
+}
+
+// handleClient opens a tunnel for cc and pumps bytes both ways until
+// either side closes or fails, only this client is torn down. Unless
+// the tunnel is what went away it's drained before it's closed so no
+// data the client sent gets dropped.
+func (orca *Orca) handleClient(ctx context.Context, cc *clientConnection) {
+	defer close(cc.done)
+	defer cc.local.Close()
+	tunnel, err := newConn(ctx, orca.tunnelConn.newSession())
+	if err != nil {
+		orca.clientFailed(cc, fmt.Errorf("opening tunnel: %w", err))
+		return
+	}
+	orca.connectionsMu.Lock()
+	cc.tunnel = tunnel
+	orca.connectionsMu.Unlock()
+	if interval := orca.tunnelConn.latencyProbeInterval; interval > 0 {
+		go orca.logLatency(cc, tunnel, interval)
+	}
+	pumpErrs := make(chan error, 2)
+	go func() {
+		pumpErrs <- pump(tunnel, cc.local, localClosed, tunnelClosed)
+	}()
+	go func() {
+		pumpErrs <- pump(cc.local, tunnel, tunnelClosed, localClosed)
+	}()
+	var errs []error
+	err = <-pumpErrs
+	if !isCleanClose(err) {
+		errs = append(errs, err)
+	}
+	var localErr *LocalClosedError
+	if errors.As(err, &localErr) {
+		drainCtx, cancel := context.WithTimeout(context.Background(), orca.drainTimeout)
+		err := tunnel.Drain(drainCtx)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("draining tunnel: %w", err))
+		}
+	}
+	err = tunnel.Close()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("closing tunnel: %w", err))
+	}
+	cc.local.Close()
+	// the other pump only fails because its ends were just closed
+	<-pumpErrs
+	orca.clientFailed(cc, errors.Join(errs...))
+	fmt.Fprintf(orca.log, "Client disconnected: %s\n", cc.local.RemoteAddr())
+}
+
+// logLatency logs the client's tunnel latency every interval once a
+// probe has been answered, until the client is done.
+func (orca *Orca) logLatency(cc *clientConnection, tunnel *Conn, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			latency := tunnel.Latency()
+			if latency > 0 {
+				fmt.Fprintf(orca.log, "Client %s latency: %s\n", cc.local.RemoteAddr(), latency.Round(100*time.Microsecond))
+			}
+		case <-cc.done:
+			return
+		}
+	}
+}
+
+// clientFailed hands err to the error handler, or keeps it for Run
+// to return if Orca is shutting down.
+func (orca *Orca) clientFailed(cc *clientConnection, err error) {
+	if err == nil {
+		return
+	}
+	orca.connectionsMu.Lock()
+	shuttingDown := orca.shuttingDown
+	if shuttingDown {
+		cc.err = err
+	}
+	orca.connectionsMu.Unlock()
+	if !shuttingDown && orca.clientErrors != nil {
+		orca.clientErrors(cc.local.RemoteAddr(), err)
+	}
+}
+
+// pump copies src to dst until either of them fails, the error says
+// which side it was.
+func pump(dst io.Writer, src io.Reader, srcErr, dstErr func(error) error) error {
+	buf := make([]byte, maxDataFrameSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			_, werr := dst.Write(buf[:n])
+			if werr != nil {
+				return dstErr(werr)
+			}
+		}
+		if err != nil {
+			return srcErr(err)
+		}
+	}
+}
+
+func localClosed(err error) error {
+	return &LocalClosedError{Err: err}
+}
+
+// tunnelClosed leaves errors that already say what went wrong with
+// the tunnel alone.
+func tunnelClosed(err error) error {
+	var authErr *AuthError
+	var protocolErr *ProtocolError
+	if errors.As(err, &authErr) || errors.As(err, &protocolErr) {
+		return err
+	}
+	return &TunnelClosedError{Err: err}
+}
+
+// shutdownClient half-closes the client so nothing more is read from it,
+// handleClient then drains the tunnel and closes both ends. Whatever is
+// left when ctx is done gets closed without waiting for acks.
+func (orca *Orca) shutdownClient(ctx context.Context, cc *clientConnection) error {
+	if cr, ok := cc.local.(interface{ CloseRead() error }); ok {
+		cr.CloseRead()
+	} else {
+		cc.local.SetReadDeadline(time.Now())
+	}
+	var errs []error
+	select {
+	case <-cc.done:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("waiting for acks: %w", ctx.Err()))
+		cc.local.Close()
+		orca.connectionsMu.Lock()
+		tunnel := cc.tunnel
+		orca.connectionsMu.Unlock()
+		if tunnel != nil {
+			tunnel.Close()
+		}
+		<-cc.done
+	}
+	errs = append(errs, cc.err)
+	err := errors.Join(errs...)
+	if err != nil {
+		return fmt.Errorf("client %s: %w", cc.local.RemoteAddr(), err)
+	}
+	return nil
+}
+
+// cleanDeadClientConnections drops the connections whose client has gone.
+func (orca *Orca) cleanDeadClientConnections() {
+	orca.connectionsMu.Lock()
+	defer orca.connectionsMu.Unlock()
+	live := orca.connections[:0]
+	for _, cc := range orca.connections {
+		if !isClosedChan(cc.done) {
+			live = append(live, cc)
+		}
+	}
+	for i := len(live); i < len(orca.connections); i++ {
+		orca.connections[i] = nil
+	}
+	orca.connections = live
+}
+
+// closeClientConnections shuts every client down at the same time.
+func (orca *Orca) closeClientConnections(ctx context.Context) error {
+	orca.connectionsMu.Lock()
+	connections := orca.connections
+	orca.connections = nil
+	orca.connectionsMu.Unlock()
+	errs := make([]error, len(connections))
+	var wg sync.WaitGroup
+	for i, cc := range connections {
+		wg.Add(1)
+		go func(i int, cc *clientConnection) {
+			defer wg.Done()
+			errs[i] = orca.shutdownClient(ctx, cc)
+		}(i, cc)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
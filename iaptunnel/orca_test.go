@@ -0,0 +1,841 @@
+package iaptunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/eahrend/gcp-iap-tunnel-parser/iaptunnel/codec"
+	"github.com/eahrend/gcp-iap-tunnel-parser/iaptunnel/iaptest"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startEchoBackend stands in for the instance port.
+func startEchoBackend(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// withRelay points the tunnel at srv instead of IAP and looks the
+// instance up in defaultCompute.
+func withRelay(srv *iaptest.Server) TunnelConnectionOption {
+	computeSrv := defaultCompute()
+	return func(tc *TunnelConnection) {
+		WithBaseURL(srv.URL)(tc)
+		withCompute(computeSrv)(tc)
+		tc.tokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "test-token"})
+	}
+}
+
+var (
+	defaultComputeOnce sync.Once
+	defaultComputeSrv  *httptest.Server
+)
+
+// defaultCompute is a fake compute API with test-instance running in
+// test-zone, shared by every test.
+func defaultCompute() *httptest.Server {
+	defaultComputeOnce.Do(func() {
+		defaultComputeSrv = newFakeCompute(&compute.Instance{
+			Name:              "test-instance",
+			Zone:              "test-zone",
+			Status:            "RUNNING",
+			NetworkInterfaces: []*compute.NetworkInterface{{Name: "nic0"}},
+		})
+	})
+	return defaultComputeSrv
+}
+
+// newFakeCompute serves the instance lists of the compute API from
+// instances, their Zone is the zone name alone. Filters are ignored.
+func newFakeCompute(instances ...*compute.Instance) *httptest.Server {
+	return httptest.NewServer(fakeComputeHandler(instances...))
+}
+
+func fakeComputeHandler(instances ...*compute.Instance) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/compute/v1/projects/"), "/")
+		// lookups filter by name, anything else is a broken filter
+		name, err := strconv.Unquote(strings.TrimPrefix(r.URL.Query().Get("filter"), "name = "))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid filter %q", r.URL.Query().Get("filter")), http.StatusBadRequest)
+			return
+		}
+		var resp interface{}
+		switch {
+		case len(parts) == 3 && parts[1] == "aggregated" && parts[2] == "instances":
+			items := map[string]compute.InstancesScopedList{}
+			for _, instance := range instances {
+				if instance.Name != name {
+					continue
+				}
+				scoped := items["zones/"+instance.Zone]
+				scoped.Instances = append(scoped.Instances, withZoneURL(instance))
+				items["zones/"+instance.Zone] = scoped
+			}
+			resp = &compute.InstanceAggregatedList{Items: items}
+		case len(parts) == 4 && parts[1] == "zones" && parts[3] == "instances":
+			list := &compute.InstanceList{}
+			for _, instance := range instances {
+				if instance.Zone == parts[2] && instance.Name == name {
+					list.Items = append(list.Items, withZoneURL(instance))
+				}
+			}
+			resp = list
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+func withZoneURL(instance *compute.Instance) *compute.Instance {
+	copied := *instance
+	copied.Zone = "https://www.googleapis.com/compute/v1/projects/test-project/zones/" + instance.Zone
+	return &copied
+}
+
+// withCompute makes the instance lookups go to srv, a fake compute API.
+func withCompute(srv *httptest.Server) TunnelConnectionOption {
+	return func(tc *TunnelConnection) {
+		tc.computeOptions = withComputeOptions(srv)
+	}
+}
+
+func withComputeOptions(srv *httptest.Server) []option.ClientOption {
+	return []option.ClientOption{
+		option.WithEndpoint(srv.URL + "/compute/v1/projects/"),
+		option.WithHTTPClient(srv.Client()),
+	}
+}
+
+type testOrca struct {
+	addr string
+	// errs gets what the client error handler is called with
+	errs   chan error
+	cancel context.CancelFunc
+	done   chan error
+	// stopOnce keeps Run's error, checked is set once a test has
+	// looked at it so the cleanup doesn't
+	stopOnce sync.Once
+	err      error
+	checked  bool
+}
+
+func startOrca(t *testing.T, srv *iaptest.Server, opts ...TunnelConnectionOption) *testOrca {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	o := &testOrca{errs: make(chan error, 16), cancel: cancel, done: make(chan error, 1)}
+	tunnelOpts := append([]TunnelConnectionOption{
+		WithProject("test-project"),
+		WithZone("test-zone"),
+		WithInstanceName("test-instance"),
+		WithPort("22"),
+		withRelay(srv),
+	}, opts...)
+	orca, err := NewOrca(ctx,
+		WithTunnelConnectionOptions(tunnelOpts...),
+		WithLocalConnOptions(WithLocalConnHost("127.0.0.1"), WithLocalConnPort("0")),
+		WithDrainTimeout(time.Second),
+		WithLogWriter(io.Discard),
+		WithClientErrorHandler(func(_ net.Addr, err error) { o.errs <- err }))
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	o.addr = orca.Addr().String()
+	go func() { o.done <- orca.Run(ctx) }()
+	t.Cleanup(func() {
+		checked := o.checked
+		err := o.stop()
+		if !checked && err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	})
+	return o
+}
+
+// stop cancels Orca and returns what Run did.
+func (o *testOrca) stop() error {
+	o.stopOnce.Do(func() {
+		o.cancel()
+		o.err = <-o.done
+	})
+	o.checked = true
+	return o.err
+}
+
+// echo sends payload through the tunnel and checks it comes back intact.
+func echo(t *testing.T, addr string, payload []byte) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	go c.Write(payload)
+	got := make([]byte, len(payload))
+	_, err = io.ReadFull(c, got)
+	if err != nil {
+		t.Errorf("reading echo: %v", err)
+		return
+	}
+	if !bytes.Equal(got, payload) {
+		t.Error("echo doesn't match what was sent")
+	}
+}
+
+func randomPayload(t *testing.T, n int) []byte {
+	payload := make([]byte, n)
+	_, err := rand.Read(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestOrcaEcho(t *testing.T) {
+	srv := iaptest.NewServer(startEchoBackend(t))
+	defer srv.Close()
+	o := startOrca(t, srv)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			echo(t, o.addr, randomPayload(t, 256<<10))
+		}()
+	}
+	wg.Wait()
+	connects := srv.Connects()
+	if len(connects) != 3 {
+		t.Fatalf("%d connects, want one per client", len(connects))
+	}
+	for key, want := range map[string]string{
+		"project":   "test-project",
+		"zone":      "test-zone",
+		"instance":  "test-instance",
+		"interface": "nic0",
+		"port":      "22",
+	} {
+		if got := connects[0].Query.Get(key); got != want {
+			t.Errorf("connect %s = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestOrcaSplitAndDelayedFrames(t *testing.T) {
+	srv := iaptest.NewServer(startEchoBackend(t))
+	defer srv.Close()
+	srv.SetFaults(iaptest.Faults{SplitFrames: true, Delay: time.Millisecond})
+	o := startOrca(t, srv)
+	echo(t, o.addr, randomPayload(t, 64<<10))
+}
+
+func TestOrcaReconnectReplaysData(t *testing.T) {
+	srv := iaptest.NewServer(startEchoBackend(t))
+	defer srv.Close()
+	srv.SetFaults(iaptest.Faults{DropAfter: 100 << 10})
+	o := startOrca(t, srv)
+	echo(t, o.addr, randomPayload(t, 1<<20))
+	if srv.Reconnects() == 0 {
+		t.Error("the websocket was never dropped")
+	}
+}
+
+func TestOrcaDroppedWebsocket(t *testing.T) {
+	srv := iaptest.NewServer(startEchoBackend(t))
+	defer srv.Close()
+	o := startOrca(t, srv)
+	c, err := net.Dial("tcp", o.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 5)
+	for i := 0; i < 3; i++ {
+		_, err = c.Write([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.ReadFull(c, buf)
+		if err != nil || string(buf) != "hello" {
+			t.Fatalf("echo %d = %q, %v", i, buf, err)
+		}
+		srv.Drop()
+	}
+}
+
+func TestOrcaReauthentication(t *testing.T) {
+	srv := iaptest.NewServer(startEchoBackend(t))
+	defer srv.Close()
+	o := startOrca(t, srv)
+	c, err := net.Dial("tcp", o.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 5)
+	c.Write([]byte("hello"))
+	io.ReadFull(c, buf)
+	// the first request for a new token is a reconnect
+	srv.Disconnect(iaptest.CloseCodeReauthenticationRequired, "reauth")
+	c.Write([]byte("again"))
+	_, err = io.ReadFull(c, buf)
+	if err != nil || string(buf) != "again" {
+		t.Fatalf("echo after reauthentication = %q, %v", buf, err)
+	}
+	// another within a minute means the new token wasn't good either
+	srv.Disconnect(iaptest.CloseCodeReauthenticationRequired, "reauth")
+	select {
+	case err := <-o.errs:
+		var authErr *AuthError
+		if !errors.As(err, &authErr) {
+			t.Fatalf("client error = %v, want an AuthError", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client didn't fail")
+	}
+}
+
+func TestOrcaNotAuthorized(t *testing.T) {
+	srv := iaptest.NewServer(startEchoBackend(t))
+	defer srv.Close()
+	o := startOrca(t, srv)
+	c, err := net.Dial("tcp", o.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 5)
+	c.Write([]byte("hello"))
+	io.ReadFull(c, buf)
+	srv.Disconnect(iaptest.CloseCodeNotAuthorized, "not authorized")
+	_, err = c.Read(buf)
+	if err == nil {
+		t.Fatal("the client wasn't disconnected")
+	}
+	var authErr *AuthError
+	if err := <-o.errs; !errors.As(err, &authErr) {
+		t.Fatalf("client error = %v, want an AuthError", err)
+	}
+}
+
+func TestOrcaBadTag(t *testing.T) {
+	srv := iaptest.NewServer(startEchoBackend(t))
+	defer srv.Close()
+	srv.SetFaults(iaptest.Faults{BadTag: true})
+	o := startOrca(t, srv)
+	c, err := net.Dial("tcp", o.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = c.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("the client wasn't disconnected")
+	}
+	var protocolErr *ProtocolError
+	if err := <-o.errs; !errors.As(err, &protocolErr) {
+		t.Fatalf("client error = %v, want a ProtocolError", err)
+	}
+	// only that client is gone, the next one gets through
+	srv.SetFaults(iaptest.Faults{})
+	echo(t, o.addr, []byte("still serving"))
+}
+
+func TestOrcaBackendCloses(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c.Write([]byte("bye"))
+		c.Close()
+	}()
+	srv := iaptest.NewServer(l.Addr().String())
+	defer srv.Close()
+	o := startOrca(t, srv)
+	c, err := net.Dial("tcp", o.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	got, err := io.ReadAll(c)
+	if err != nil || string(got) != "bye" {
+		t.Fatalf("read %q, %v, want everything before the instance closed", got, err)
+	}
+}
+
+// startPipeOrca runs Orca with a pipe pair as its only client, like
+// --listen-on-stdin, it returns the client's ends and Run's error.
+func startPipeOrca(t *testing.T, srv *iaptest.Server, clientErrs chan<- error) (io.WriteCloser, io.Reader, <-chan error) {
+	t.Helper()
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	orca, err := NewOrca(context.Background(),
+		WithTunnelConnectionOptions(
+			WithProject("test-project"),
+			WithZone("test-zone"),
+			WithInstanceName("test-instance"),
+			WithPort("22"),
+			withRelay(srv)),
+		WithLocalConnOptions(WithLocalConnReader(inR), WithLocalConnWriter(outW)),
+		WithDrainTimeout(time.Second),
+		WithLogWriter(io.Discard),
+		WithClientErrorHandler(func(_ net.Addr, err error) { clientErrs <- err }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- orca.Run(context.Background()) }()
+	return inW, outR, done
+}
+
+func TestOrcaPipe(t *testing.T) {
+	srv := iaptest.NewServer(startEchoBackend(t))
+	defer srv.Close()
+	clientErrs := make(chan error, 1)
+	in, out, done := startPipeOrca(t, srv, clientErrs)
+	payload := randomPayload(t, 256<<10)
+	go in.Write(payload)
+	got := make([]byte, len(payload))
+	_, err := io.ReadFull(out, got)
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("echo through the pipe failed: %v", err)
+	}
+	// EOF on the reader ends the only client
+	in.Close()
+	rest, err := io.ReadAll(out)
+	if err != nil || len(rest) > 0 {
+		t.Errorf("read %q, %v after closing, want EOF", rest, err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run didn't return after EOF")
+	}
+	select {
+	case err := <-clientErrs:
+		t.Errorf("client error %v", err)
+	default:
+	}
+}
+
+func TestOrcaPipeTunnelFails(t *testing.T) {
+	srv := iaptest.NewServer(startEchoBackend(t))
+	// nothing is listening on the relay anymore
+	srv.Close()
+	clientErrs := make(chan error, 1)
+	in, out, done := startPipeOrca(t, srv, clientErrs)
+	defer in.Close()
+	select {
+	case err := <-clientErrs:
+		if err == nil || !strings.Contains(err.Error(), "opening tunnel") {
+			t.Errorf("client error %v, want opening the tunnel to have failed", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the client error handler wasn't called")
+	}
+	_, err := io.ReadAll(out)
+	if err != nil {
+		t.Errorf("read %v, want EOF", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run didn't return after the client failed")
+	}
+}
+
+// startSinkBackend stands in for an instance port that only reads, what
+// each connection sent is on the channel once it has n bytes.
+func startSinkBackend(t *testing.T, n int) (string, <-chan []byte) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	received := make(chan []byte, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				got := make([]byte, n)
+				_, err := io.ReadFull(c, got)
+				if err == nil {
+					received <- got
+				}
+				io.Copy(io.Discard, c)
+			}()
+		}
+	}()
+	return l.Addr().String(), received
+}
+
+// cancelWithUnacked sends payload and cancels Orca once the backend has
+// it, IAP holds the acks back by delay. It returns Run's error.
+func cancelWithUnacked(t *testing.T, delay time.Duration) error {
+	// one data frame, so the backend has it before the first ack
+	payload := randomPayload(t, 1<<10)
+	backend, received := startSinkBackend(t, len(payload))
+	srv := iaptest.NewServer(backend)
+	defer srv.Close()
+	srv.SetFaults(iaptest.Faults{Delay: delay})
+	o := startOrca(t, srv)
+	c, err := net.Dial("tcp", o.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = c.Write(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, payload) {
+			t.Error("the backend got something else than was sent")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the backend didn't get the data")
+	}
+	stopped := make(chan error, 1)
+	go func() { stopped <- o.stop() }()
+	_, err = c.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Errorf("client read %v, want EOF once Orca stopped", err)
+	}
+	return <-stopped
+}
+
+func TestOrcaCancelDrains(t *testing.T) {
+	err := cancelWithUnacked(t, 200*time.Millisecond)
+	if err != nil {
+		t.Errorf("Run: %v, want the acks waited for", err)
+	}
+}
+
+func TestOrcaCancelDrainTimeout(t *testing.T) {
+	// startOrca gives up on acks after a second
+	err := cancelWithUnacked(t, 2*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "waiting for acks") {
+		t.Errorf("Run: %v, want it to have given up waiting for acks", err)
+	}
+}
+
+func TestDialerEcho(t *testing.T) {
+	srv := iaptest.NewServer(startEchoBackend(t))
+	defer srv.Close()
+	dialer := NewDialer(WithProject("test-project"), WithZone("test-zone"), withRelay(srv))
+	c, err := dialer.DialContext(context.Background(), "test-instance:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	payload := randomPayload(t, 100<<10)
+	go c.Write(payload)
+	got := make([]byte, len(payload))
+	_, err = io.ReadFull(c, got)
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("echo through the dialer failed: %v", err)
+	}
+}
+
+// countingTokenSource counts the tokens fetched from it.
+type countingTokenSource struct {
+	mu    sync.Mutex
+	count int
+}
+
+func (ts *countingTokenSource) Token() (*oauth2.Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.count++
+	return &oauth2.Token{AccessToken: "test-token"}, nil
+}
+
+func TestDialerReusesTarget(t *testing.T) {
+	srv := iaptest.NewServer(startEchoBackend(t))
+	defer srv.Close()
+	ts := &countingTokenSource{}
+	dialer := NewDialer(WithProject("test-project"), WithZone("test-zone"), withRelay(srv), WithTokenSource(ts))
+	for i := 0; i < 3; i++ {
+		c, err := dialer.DialContext(context.Background(), "test-instance:22")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		// net.Conn users call LocalAddr whenever they like
+		if c.LocalAddr() == nil || c.LocalAddr().String() == "" {
+			t.Errorf("LocalAddr after Close = %v", c.LocalAddr())
+		}
+	}
+	if len(srv.Connects()) != 3 {
+		t.Errorf("%d connects, want one per dial", len(srv.Connects()))
+	}
+	// the token doesn't expire, so sharing the cache means one fetch
+	if ts.count != 1 {
+		t.Errorf("%d tokens fetched, want the dials to share one", ts.count)
+	}
+}
+
+// countingCompute is a fake compute API counting the instance lookups,
+// the ones for an instance called slow wait for release.
+type countingCompute struct {
+	*httptest.Server
+	mu      sync.Mutex
+	lookups int
+	release chan struct{}
+}
+
+func newCountingCompute(instances ...*compute.Instance) *countingCompute {
+	c := &countingCompute{release: make(chan struct{})}
+	handler := fakeComputeHandler(instances...)
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		c.lookups++
+		c.mu.Unlock()
+		if strings.Contains(r.URL.Query().Get("filter"), "slow") {
+			<-c.release
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	return c
+}
+
+func (c *countingCompute) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lookups
+}
+
+func TestDialerTargetsDontWait(t *testing.T) {
+	srv := iaptest.NewServer(startEchoBackend(t))
+	defer srv.Close()
+	nic0 := []*compute.NetworkInterface{{Name: "nic0"}}
+	computeSrv := newCountingCompute(
+		&compute.Instance{Name: "test-instance", Zone: "test-zone", Status: "RUNNING", NetworkInterfaces: nic0},
+		&compute.Instance{Name: "slow", Zone: "test-zone", Status: "RUNNING", NetworkInterfaces: nic0})
+	defer computeSrv.Close()
+	defer close(computeSrv.release)
+	dialer := NewDialer(WithProject("test-project"), WithZone("test-zone"), withRelay(srv), withCompute(computeSrv.Server))
+	slowErr := make(chan error, 1)
+	go func() {
+		_, err := dialer.DialContext(context.Background(), "slow:22")
+		slowErr <- err
+	}()
+	for computeSrv.count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// another target isn't held up by the lookup of slow
+	c, err := dialer.DialContext(context.Background(), "test-instance:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	// and a dial waiting for it can give up
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = dialer.DialContext(ctx, "slow:22")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("dial waiting for the lookup = %v, want the deadline", err)
+	}
+	select {
+	case err := <-slowErr:
+		t.Errorf("slow dial returned %v before its lookup", err)
+	default:
+	}
+	if n := computeSrv.count(); n != 2 {
+		t.Errorf("%d lookups, want one per target", n)
+	}
+}
+
+func TestDialerForgetsGoneInstance(t *testing.T) {
+	srv := iaptest.NewServer(startEchoBackend(t))
+	defer srv.Close()
+	computeSrv := newCountingCompute(&compute.Instance{
+		Name: "test-instance", Zone: "test-zone", Status: "RUNNING",
+		NetworkInterfaces: []*compute.NetworkInterface{{Name: "nic0"}},
+	})
+	defer computeSrv.Close()
+	dialer := NewDialer(WithProject("test-project"), WithZone("test-zone"), withRelay(srv), withCompute(computeSrv.Server))
+	dial := func() error {
+		c, err := dialer.DialContext(context.Background(), "test-instance:22")
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		err := dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := computeSrv.count(); n != 1 {
+		t.Fatalf("%d lookups, want the target reused", n)
+	}
+	// the instance went away, say a MIG recreated it in another zone
+	srv.SetFaults(iaptest.Faults{RefuseConnect: iaptest.CloseCodeLookupFailed})
+	err := dial()
+	var notFound *InstanceNotFoundError
+	if !errors.As(err, &notFound) || notFound.Instance != "test-instance" {
+		t.Fatalf("dial = %v, want an InstanceNotFoundError", err)
+	}
+	srv.SetFaults(iaptest.Faults{})
+	err = dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := computeSrv.count(); n != 2 {
+		t.Errorf("%d lookups, want the instance looked up again", n)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	srv := iaptest.NewServer(startEchoBackend(t))
+	defer srv.Close()
+	dialer := NewDialer(WithProject("test-project"), WithZone("test-zone"), withRelay(srv),
+		WithLatencyProbeInterval(10*time.Millisecond))
+	c, err := dialer.DialContext(context.Background(), "test-instance:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for c.(*Conn).Latency() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no latency probe answered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// IAP probes with an ACK_LATENCY too, which has to be answered
+	srv.RequestLatency(12345)
+	for len(srv.LatencyAnswers()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("latency request not answered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := srv.LatencyAnswers(); got[0] != 12345 {
+		t.Errorf("answered %v, want the requested timestamp", got)
+	}
+}
+
+func TestLatencyStaleReplies(t *testing.T) {
+	srv := iaptest.NewServer(startEchoBackend(t))
+	defer srv.Close()
+	dialer := NewDialer(WithProject("test-project"), WithZone("test-zone"), withRelay(srv))
+	nc, err := dialer.DialContext(context.Background(), "test-instance:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	c := nc.(*Conn)
+	// a reply to a probe that was forgotten, or never sent
+	c.handleLatencyReply(&codec.ReplyLatencyFrame{Timestamp: 999})
+	if c.Latency() != 0 {
+		t.Errorf("latency %s from a reply to no probe", c.Latency())
+	}
+	// the same reply twice only counts once
+	timestamp := uint64(time.Since(c.start))
+	c.probesMu.Lock()
+	c.probes = append(c.probes, timestamp)
+	c.probesMu.Unlock()
+	c.handleLatencyReply(&codec.ReplyLatencyFrame{Timestamp: timestamp})
+	latency := c.Latency()
+	if latency == 0 {
+		t.Fatal("the reply to an outstanding probe wasn't recorded")
+	}
+	time.Sleep(10 * time.Millisecond)
+	c.handleLatencyReply(&codec.ReplyLatencyFrame{Timestamp: timestamp})
+	if c.Latency() != latency {
+		t.Errorf("latency %s after a duplicate reply, want %s", c.Latency(), latency)
+	}
+	// replies are never answered, the relay would echo those back
+	time.Sleep(100 * time.Millisecond)
+	if n := srv.LatencyProbes(); n != 0 {
+		t.Errorf("%d latency frames sent for stale replies, want none", n)
+	}
+}
+
+func TestLatencyProbesEvictOldest(t *testing.T) {
+	srv := iaptest.NewServer(startEchoBackend(t))
+	defer srv.Close()
+	dialer := NewDialer(WithProject("test-project"), WithZone("test-zone"), withRelay(srv))
+	nc, err := dialer.DialContext(context.Background(), "test-instance:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	c := nc.(*Conn)
+	// probes IAP never answered, timestamps no real probe has
+	c.probesMu.Lock()
+	for i := 0; i < maxOutstandingProbes; i++ {
+		c.probes = append(c.probes, uint64(i))
+	}
+	c.probesMu.Unlock()
+	err = c.sendLatencyProbe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.probesMu.Lock()
+	defer c.probesMu.Unlock()
+	// the new probe can already be answered
+	if c.probes[0] != 1 || c.probes[maxOutstandingProbes-2] != maxOutstandingProbes-1 {
+		t.Errorf("outstanding probes %v, want only probe 0 forgotten", c.probes)
+	}
+}
@@ -0,0 +1,143 @@
+package iaptunnel
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// pipeConn is a net.Conn over a reader and a writer, like stdin and
+// stdout. Reading happens in the background so Close, CloseRead and
+// deadlines work even when the reader can't be interrupted.
+type pipeConn struct {
+	reader       io.Reader
+	writer       io.Writer
+	data         chan []byte
+	readErr      error
+	pending      []byte
+	readMu       sync.Mutex
+	readDeadline deadline
+	readClosed   chan struct{}
+	readOnce     sync.Once
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+// pipeAddr is the address of both ends of a pipeConn.
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (pipeAddr) String() string {
+	return "stdio"
+}
+
+func newPipeConn(reader io.Reader, writer io.Writer) *pipeConn {
+	c := &pipeConn{
+		reader:       reader,
+		writer:       writer,
+		data:         make(chan []byte),
+		readDeadline: makeDeadline(),
+		readClosed:   make(chan struct{}),
+		closed:       make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *pipeConn) readLoop() {
+	defer close(c.data)
+	for {
+		buf := make([]byte, maxDataFrameSize)
+		n, err := c.reader.Read(buf)
+		if n > 0 {
+			select {
+			case c.data <- buf[:n]:
+			case <-c.closed:
+				return
+			}
+		}
+		if err != nil {
+			c.readErr = err
+			return
+		}
+	}
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(c.pending) == 0 {
+		select {
+		case data, ok := <-c.data:
+			if !ok {
+				return 0, c.readErr
+			}
+			c.pending = data
+		case <-c.readClosed:
+			return 0, io.EOF
+		case <-c.closed:
+			return 0, net.ErrClosed
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	if isClosedChan(c.closed) {
+		return 0, net.ErrClosed
+	}
+	return c.writer.Write(b)
+}
+
+// CloseRead makes Read return io.EOF, whatever is left unread is dropped.
+func (c *pipeConn) CloseRead() error {
+	c.readOnce.Do(func() { close(c.readClosed) })
+	return nil
+}
+
+// Close closes the reader and writer if they can be closed.
+func (c *pipeConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = nil
+		if closer, ok := c.writer.(io.Closer); ok {
+			err = closer.Close()
+		}
+		if closer, ok := c.reader.(io.Closer); ok {
+			closer.Close()
+		}
+	})
+	return err
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return pipeAddr{}
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return pipeAddr{}
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes go straight to the writer.
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
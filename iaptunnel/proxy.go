@@ -0,0 +1,158 @@
+package iaptunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ProxyError is a proxy refusing to open the tunnel to the relay,
+// StatusCode 407 means the proxy credentials are missing or wrong.
+type ProxyError struct {
+	Proxy      string
+	StatusCode int
+	Status     string
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("proxy %s refused CONNECT: %s", e.Proxy, e.Status)
+}
+
+// proxyDialer opens TCP connections through an HTTP CONNECT proxy. Unlike
+// the websocket package's own proxy support it can talk TLS to the proxy.
+type proxyDialer struct {
+	// proxy picks the proxy for a request, nil means a direct connection
+	proxy     func(*http.Request) (*url.URL, error)
+	tlsConfig *tls.Config
+	// dial opens the TCP connections, to the proxy or the relay
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// newProxyDialer wraps dialer so its proxy is dialed by a proxyDialer.
+func newProxyDialer(dialer websocket.Dialer, proxy func(*http.Request) (*url.URL, error), tlsConfig *tls.Config) *websocket.Dialer {
+	pd := &proxyDialer{proxy: proxy, tlsConfig: tlsConfig, dial: dialer.NetDialContext}
+	if pd.dial == nil {
+		pd.dial = (&net.Dialer{}).DialContext
+	}
+	dialer.Proxy = nil
+	dialer.NetDialContext = pd.DialContext
+	return &dialer
+}
+
+func (d *proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	// the relay is always reached over TLS, so it's HTTPS_PROXY that applies
+	proxyURL, err := d.proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return d.dial(ctx, network, addr)
+	}
+	conn, err := d.dial(ctx, "tcp", proxyHostPort(proxyURL))
+	if err != nil {
+		return nil, fmt.Errorf("dialing proxy: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if proxyURL.Scheme == "https" {
+		config := &tls.Config{}
+		if d.tlsConfig != nil {
+			config = d.tlsConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = proxyURL.Hostname()
+		}
+		tlsConn := tls.Client(conn, config)
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS to proxy: %w", err)
+		}
+		conn = tlsConn
+	}
+	err = connect(conn, proxyURL, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// connect asks the proxy on conn for a tunnel to addr, the user info of
+// proxyURL is sent as basic auth.
+func connect(conn net.Conn, proxyURL *url.URL, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	err := req.Write(conn)
+	if err != nil {
+		return fmt.Errorf("writing CONNECT to proxy: %w", err)
+	}
+	// the relay doesn't talk before the TLS handshake, so the reader
+	// can't have buffered anything past the response
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("reading CONNECT response from proxy: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &ProxyError{Proxy: proxyURL.Redacted(), StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return nil
+}
+
+func proxyHostPort(proxyURL *url.URL) string {
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
+	}
+	if proxyURL.Scheme == "https" {
+		return net.JoinHostPort(proxyURL.Hostname(), "443")
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), "80")
+}
+
+// proxyTransport is the transport of the API calls the tunnel makes,
+// through the same proxy as the websocket.
+func (tc *TunnelConnection) proxyTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(tc.proxyURL)
+	if tc.proxyTLSConfig != nil {
+		transport.TLSClientConfig = tc.proxyTLSConfig.Clone()
+	}
+	return transport
+}
+
+// WithProxyURL sends everything through the HTTP proxy at proxyURL
+// instead of the one in HTTPS_PROXY, http and https proxies work and user
+// info in the URL is sent as basic auth.
+func WithProxyURL(proxyURL *url.URL) TunnelConnectionOption {
+	return func(tc *TunnelConnection) {
+		tc.proxyURL = proxyURL
+	}
+}
+
+// WithProxyTLSConfig sets the TLS config for an https proxy, RootCAs
+// needs the proxy's CA. It's also used for the API calls, so when the
+// proxy doesn't intercept TLS it needs the system roots as well.
+func WithProxyTLSConfig(config *tls.Config) TunnelConnectionOption {
+	return func(tc *TunnelConnection) {
+		tc.proxyTLSConfig = config
+	}
+}
@@ -0,0 +1,107 @@
+package iaptunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/eahrend/gcp-iap-tunnel-parser/iaptunnel/iaptest"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// connectProxy is an HTTP CONNECT proxy wanting basic auth as user:pass.
+type connectProxy struct {
+	mu      sync.Mutex
+	targets []string
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT", http.StatusMethodNotAllowed)
+		return
+	}
+	user, password, ok := (&http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}).BasicAuth()
+	if !ok || user != "user" || password != "pass" {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="test"`)
+		http.Error(w, "who are you", http.StatusProxyAuthRequired)
+		return
+	}
+	p.mu.Lock()
+	p.targets = append(p.targets, r.Host)
+	p.mu.Unlock()
+	target, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	client, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		target.Close()
+		return
+	}
+	client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go func() {
+		defer target.Close()
+		io.Copy(target, buf)
+	}()
+	go func() {
+		defer client.Close()
+		io.Copy(client, target)
+	}()
+}
+
+func (p *connectProxy) connects() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.targets)
+}
+
+func proxyURL(t *testing.T, srv *httptest.Server, user *url.Userinfo) *url.URL {
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.User = user
+	return u
+}
+
+func TestProxy(t *testing.T) {
+	relay := iaptest.NewServer(startEchoBackend(t))
+	defer relay.Close()
+	proxy := &connectProxy{}
+	httpProxy := httptest.NewServer(proxy)
+	defer httpProxy.Close()
+	httpsProxy := httptest.NewTLSServer(proxy)
+	defer httpsProxy.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(httpsProxy.Certificate())
+
+	err := dialEcho(t, withRelay(relay), WithProxyURL(proxyURL(t, httpProxy, url.UserPassword("user", "pass"))))
+	if err != nil {
+		t.Fatalf("through an http proxy: %v", err)
+	}
+	err = dialEcho(t, withRelay(relay),
+		WithProxyURL(proxyURL(t, httpsProxy, url.UserPassword("user", "pass"))),
+		WithProxyTLSConfig(&tls.Config{RootCAs: roots}))
+	if err != nil {
+		t.Fatalf("through an https proxy: %v", err)
+	}
+	if proxy.connects() != 2 {
+		t.Errorf("the proxy tunneled %d connections, want 2", proxy.connects())
+	}
+
+	err = dialEcho(t, withRelay(relay), WithProxyURL(proxyURL(t, httpProxy, url.UserPassword("user", "wrong"))))
+	var proxyErr *ProxyError
+	if !errors.As(err, &proxyErr) || proxyErr.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("with the wrong password = %v, want a 407 ProxyError", err)
+	}
+	err = dialEcho(t, withRelay(relay), WithProxyURL(proxyURL(t, httpsProxy, url.UserPassword("user", "pass"))))
+	if err == nil {
+		t.Fatal("dialed an https proxy with an unknown certificate authority")
+	}
+}
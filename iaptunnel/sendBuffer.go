@@ -0,0 +1,137 @@
+package iaptunnel
+
+import (
+	"context"
+	"fmt"
+	"github.com/eahrend/gcp-iap-tunnel-parser/iaptunnel/codec"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// sendBuffer holds the data frames sent to IAP until they're acked,
+// whatever is left in it is replayed in order after a reconnect.
+type sendBuffer struct {
+	mu sync.Mutex
+	// frames are ordered by sequence number, which is the count
+	// of bytes sent before the frame.
+	frames         []*codec.IAPDataMessage
+	bytesSent      uint64
+	bytesConfirmed uint64
+	// size is the payload held in frames, pushing blocks once
+	// it reaches limit until acks free some up.
+	size  int
+	limit int
+	// space is closed and replaced whenever acks free up space
+	space chan struct{}
+}
+
+func newSendBuffer(limit int) *sendBuffer {
+	return &sendBuffer{
+		limit: limit,
+		space: make(chan struct{}),
+	}
+}
+
+// push creates the data frame for payload and holds on to it until
+// it's confirmed.
+func (b *sendBuffer) push(payload []byte) (*codec.IAPDataMessage, error) {
+	msg := codec.NewIAPDataMessage(payload)
+	err := msg.CreateDataFrame()
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msg.SetSequenceNumber(b.bytesSent)
+	b.frames = append(b.frames, msg)
+	b.bytesSent = msg.GetExpectedAck()
+	b.size += len(payload)
+	return msg, nil
+}
+
+// waitForSpace blocks until n more bytes fit in the buffer, an empty buffer
+// always has room so frames bigger than the limit still go out.
+func (b *sendBuffer) waitForSpace(n int, deadline time.Time, stop <-chan struct{}) error {
+	var timeout <-chan time.Time
+	for {
+		b.mu.Lock()
+		if b.size == 0 || b.size+n <= b.limit {
+			b.mu.Unlock()
+			return nil
+		}
+		space := b.space
+		b.mu.Unlock()
+		if timeout == nil && !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-space:
+		case <-timeout:
+			return os.ErrDeadlineExceeded
+		case <-stop:
+			return net.ErrClosed
+		}
+	}
+}
+
+// waitForEmpty blocks until every frame has been confirmed.
+func (b *sendBuffer) waitForEmpty(ctx context.Context, stop <-chan struct{}) error {
+	for {
+		b.mu.Lock()
+		if len(b.frames) == 0 {
+			b.mu.Unlock()
+			return nil
+		}
+		space := b.space
+		b.mu.Unlock()
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-stop:
+			return net.ErrClosed
+		}
+	}
+}
+
+// confirm frees the frames covered by ack, IAP only acks whole frames.
+func (b *sendBuffer) confirm(ack uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ack > b.bytesSent {
+		return fmt.Errorf("IAP acked %d bytes but only %d were sent", ack, b.bytesSent)
+	}
+	if ack <= b.bytesConfirmed {
+		return nil
+	}
+	i := 0
+	for ; i < len(b.frames); i++ {
+		msg := b.frames[i]
+		if msg.GetExpectedAck() > ack {
+			break
+		}
+		b.size -= int(msg.GetExpectedAck() - msg.GetSequenceNumber())
+		b.bytesConfirmed = msg.GetExpectedAck()
+		b.frames[i] = nil
+	}
+	b.frames = b.frames[i:]
+	if len(b.frames) == 0 {
+		b.frames = nil
+	}
+	close(b.space)
+	b.space = make(chan struct{})
+	return nil
+}
+
+// unacked returns the frames IAP hasn't confirmed yet, oldest first.
+func (b *sendBuffer) unacked() []*codec.IAPDataMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	frames := make([]*codec.IAPDataMessage, len(b.frames))
+	copy(frames, b.frames)
+	return frames
+}
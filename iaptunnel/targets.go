@@ -0,0 +1,133 @@
+package iaptunnel
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+	"path"
+	"sort"
+)
+
+// Target is an instance that can be tunneled to.
+type Target struct {
+	Name   string
+	Zone   string
+	Status string
+	// NetworkInterfaces are the names that go in WithNic, nic0 and up
+	NetworkInterfaces []string
+}
+
+// ListTargets lists the instances of project in zone, or in every
+// zone when zone is empty, sorted by zone and name. A nil ts uses the
+// application default credentials.
+func ListTargets(ctx context.Context, project, zone string, ts oauth2.TokenSource) ([]Target, error) {
+	if ts == nil {
+		var err error
+		ts, err = DefaultTokenSource(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	computeService, err := compute.NewService(ctx, option.WithTokenSource(ts))
+	if err != nil {
+		return nil, err
+	}
+	var targets []Target
+	addInstances := func(instances []*compute.Instance) {
+		for _, instance := range instances {
+			target := Target{
+				Name:   instance.Name,
+				Zone:   path.Base(instance.Zone),
+				Status: instance.Status,
+			}
+			for _, nic := range instance.NetworkInterfaces {
+				target.NetworkInterfaces = append(target.NetworkInterfaces, nic.Name)
+			}
+			targets = append(targets, target)
+		}
+	}
+	if zone != "" {
+		err = computeService.Instances.List(project, zone).Pages(ctx, func(list *compute.InstanceList) error {
+			addInstances(list.Items)
+			return nil
+		})
+	} else {
+		err = computeService.Instances.AggregatedList(project).Pages(ctx, func(list *compute.InstanceAggregatedList) error {
+			for _, scoped := range list.Items {
+				addInstances(scoped.Instances)
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Zone != targets[j].Zone {
+			return targets[i].Zone < targets[j].Zone
+		}
+		return targets[i].Name < targets[j].Name
+	})
+	return targets, nil
+}
+
+// findInstance looks up the instance called name in zone, or in every
+// zone of the project when zone is empty.
+func findInstance(ctx context.Context, computeService *compute.Service, project, zone, name string) (*compute.Instance, error) {
+	// the filter is quoted so names can't add clauses of their own
+	filter := fmt.Sprintf("name = %q", name)
+	var found []*compute.Instance
+	addInstances := func(instances []*compute.Instance) {
+		for _, instance := range instances {
+			if instance.Name == name {
+				found = append(found, instance)
+			}
+		}
+	}
+	var err error
+	if zone != "" {
+		err = computeService.Instances.List(project, zone).Filter(filter).Pages(ctx, func(list *compute.InstanceList) error {
+			addInstances(list.Items)
+			return nil
+		})
+	} else {
+		err = computeService.Instances.AggregatedList(project).Filter(filter).Pages(ctx, func(list *compute.InstanceAggregatedList) error {
+			for _, scoped := range list.Items {
+				addInstances(scoped.Instances)
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("looking up instance %s: %w", name, err)
+	}
+	switch len(found) {
+	case 0:
+		return nil, &InstanceNotFoundError{Project: project, Zone: zone, Instance: name}
+	case 1:
+		return found[0], nil
+	}
+	var zones []string
+	for _, instance := range found {
+		zones = append(zones, path.Base(instance.Zone))
+	}
+	sort.Strings(zones)
+	return nil, &AmbiguousInstanceError{Instance: name, Zones: zones}
+}
+
+// validateTarget checks a tunnel to nic of instance can be opened.
+func validateTarget(instance *compute.Instance, nic string) error {
+	if instance.Status != "RUNNING" {
+		return &InstanceNotRunningError{Instance: instance.Name, Status: instance.Status}
+	}
+	var nics []string
+	for _, networkInterface := range instance.NetworkInterfaces {
+		if networkInterface.Name == nic {
+			return nil
+		}
+		nics = append(nics, networkInterface.Name)
+	}
+	return &NetworkInterfaceError{Instance: instance.Name, Nic: nic, Available: nics}
+}
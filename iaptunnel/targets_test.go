@@ -0,0 +1,107 @@
+package iaptunnel
+
+import (
+	"context"
+	"errors"
+	"github.com/eahrend/gcp-iap-tunnel-parser/iaptunnel/iaptest"
+	"google.golang.org/api/compute/v1"
+	"reflect"
+	"testing"
+)
+
+func TestFindInstanceZone(t *testing.T) {
+	relay := iaptest.NewServer(startEchoBackend(t))
+	defer relay.Close()
+	nic0 := []*compute.NetworkInterface{{Name: "nic0"}}
+	srv := newFakeCompute(
+		&compute.Instance{Name: "test-instance", Zone: "us-east1-b", Status: "RUNNING", NetworkInterfaces: nic0},
+		&compute.Instance{Name: "twin", Zone: "us-east1-b", Status: "RUNNING", NetworkInterfaces: nic0},
+		&compute.Instance{Name: "twin", Zone: "europe-west1-c", Status: "RUNNING", NetworkInterfaces: nic0},
+		&compute.Instance{Name: `quoted"name`, Zone: "us-east1-b", Status: "RUNNING", NetworkInterfaces: nic0})
+	defer srv.Close()
+
+	// dialEcho sets a zone, WithZone("") takes it away again
+	opts := []TunnelConnectionOption{WithProject("test-project"), WithZone(""), withRelay(relay), withCompute(srv)}
+	err := dialEcho(t, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connects := relay.Connects()
+	if zone := connects[len(connects)-1].Query.Get("zone"); zone != "us-east1-b" {
+		t.Errorf("connect zone = %q, want the instance's", zone)
+	}
+
+	// the fake answers only lookups whose filter quotes the name
+	service, err := compute.NewService(context.Background(), withComputeOptions(srv)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, zone := range []string{"", "us-east1-b"} {
+		instance, err := findInstance(context.Background(), service, "test-project", zone, `quoted"name`)
+		if err != nil || instance.Name != `quoted"name` {
+			t.Errorf("finding a name with a quote in zone %q = %v, %v", zone, instance, err)
+		}
+	}
+
+	_, err = NewDialer(opts...).DialContext(context.Background(), "twin:22")
+	var ambiguous *AmbiguousInstanceError
+	if !errors.As(err, &ambiguous) {
+		t.Fatalf("dialing an instance in two zones = %v, want an AmbiguousInstanceError", err)
+	}
+	if want := []string{"europe-west1-c", "us-east1-b"}; !reflect.DeepEqual(ambiguous.Zones, want) {
+		t.Errorf("zones = %v, want %v", ambiguous.Zones, want)
+	}
+
+	_, err = NewDialer(opts...).DialContext(context.Background(), "missing:22")
+	var notFound *InstanceNotFoundError
+	if !errors.As(err, &notFound) || notFound.Zone != "" {
+		t.Fatalf("dialing an instance that doesn't exist = %v, want an InstanceNotFoundError", err)
+	}
+}
+
+func TestValidateTarget(t *testing.T) {
+	relay := iaptest.NewServer(startEchoBackend(t))
+	defer relay.Close()
+	nics := []*compute.NetworkInterface{{Name: "nic0"}, {Name: "nic1"}}
+	srv := newFakeCompute(
+		&compute.Instance{Name: "test-instance", Zone: "test-zone", Status: "RUNNING", NetworkInterfaces: nics},
+		&compute.Instance{Name: "stopped", Zone: "test-zone", Status: "TERMINATED", NetworkInterfaces: nics},
+		&compute.Instance{Name: "elsewhere", Zone: "other-zone", Status: "RUNNING", NetworkInterfaces: nics})
+	defer srv.Close()
+	dial := func(target string, opts ...TunnelConnectionOption) error {
+		opts = append([]TunnelConnectionOption{WithProject("test-project"), WithZone("test-zone"),
+			withRelay(relay), withCompute(srv)}, opts...)
+		c, err := NewDialer(opts...).DialContext(context.Background(), target)
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+
+	if err := dial("test-instance:22"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dial("test-instance:22", WithNic("nic1")); err != nil {
+		t.Fatal(err)
+	}
+	var notRunning *InstanceNotRunningError
+	if err := dial("stopped:22"); !errors.As(err, &notRunning) || notRunning.Status != "TERMINATED" {
+		t.Errorf("dialing a stopped instance = %v, want an InstanceNotRunningError", err)
+	}
+	var nicErr *NetworkInterfaceError
+	err := dial("test-instance:22", WithNic("nic2"))
+	if !errors.As(err, &nicErr) || !reflect.DeepEqual(nicErr.Available, []string{"nic0", "nic1"}) {
+		t.Errorf("dialing a missing network interface = %v, want a NetworkInterfaceError suggesting nic0 and nic1", err)
+	}
+	var notFound *InstanceNotFoundError
+	if err := dial("elsewhere:22"); !errors.As(err, &notFound) || notFound.Zone != "test-zone" {
+		t.Errorf("dialing an instance in another zone = %v, want an InstanceNotFoundError", err)
+	}
+	if err := dial("stopped:22", WithSkipInstanceCheck(true)); err != nil {
+		t.Errorf("dialing with the check skipped = %v", err)
+	}
+	// without a zone the instance would have to be looked up
+	if err := dial("stopped:22", WithSkipInstanceCheck(true), WithZone("")); !errors.Is(err, ErrZoneRequired) {
+		t.Errorf("skipping the check without a zone = %v, want ErrZoneRequired", err)
+	}
+}
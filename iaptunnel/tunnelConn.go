@@ -0,0 +1,502 @@
+// Package iaptunnel opens TCP tunnels to Compute Engine instances through
+// Identity-Aware Proxy without shelling out to gcloud.
+package iaptunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TunnelConnection represents the connection between your local
+// machine and the IAP
+type TunnelConnection struct {
+	// mu guards websocketConn and sid, writeMu serialises writes
+	// since a websocket connection supports one concurrent writer.
+	mu            sync.Mutex
+	writeMu       sync.Mutex
+	websocketConn *websocket.Conn
+	bytesReceived uint64
+	sid           string
+	tunnelConfig
+}
+
+// tunnelConfig is the part of TunnelConnection set through the options,
+// it's shared by every session opened to the same target.
+type tunnelConfig struct {
+	project      string
+	zone         string
+	instanceName string
+	port         string
+	nic          string
+	// reconnectTimeout is how long a dropped websocket is retried for,
+	// zero or less disables reconnecting.
+	reconnectTimeout time.Duration
+	// sendBufferSize caps the unacked data held for replay
+	sendBufferSize int
+	// latencyProbeInterval is how often latency probes are sent,
+	// zero disables them.
+	latencyProbeInterval time.Duration
+	tokenSource          oauth2.TokenSource
+	mtlsPolicy           MTLSPolicy
+	clientCertificate    ClientCertificateSource
+	// baseURL and mtlsBaseURL replace the relay endpoints, they're
+	// parsed into relayURL and mtlsRelayURL.
+	baseURL      string
+	mtlsBaseURL  string
+	relayURL     *url.URL
+	mtlsRelayURL *url.URL
+	tlsConfig    *tls.Config
+	dialer       *websocket.Dialer
+	// proxyURL replaces the proxy from the environment
+	proxyURL       *url.URL
+	proxyTLSConfig *tls.Config
+	// skipInstanceCheck leaves out looking the instance up when the
+	// zone is given, see WithSkipInstanceCheck.
+	skipInstanceCheck bool
+	// computeOptions are added to the compute API client, tests point it
+	// at a fake.
+	computeOptions []option.ClientOption
+	// log is told about what the tunnel works around, like falling
+	// back from the mTLS endpoint.
+	log io.Writer
+}
+
+const (
+	tlsBaseUri        = "tunnel.cloudproxy.app"
+	wssScheme         = "wss"
+	webSocketVersion  = "v4"
+	connectEndpoint   = "connect"
+	reconnectEndpoint = "reconnect"
+	// mtlsBaseUri asks for a client certificate, see MTLSPolicy
+	mtlsBaseUri             = "mtls.tunnel.cloudproxy.app"
+	subProtocolName         = "relay.tunnel.cloudproxy.app"
+	origin                  = "bot:iap-tunneler"
+	defaultNetworkInterface = "nic0"
+	defaultReconnectTimeout = 30 * time.Second
+	defaultSendBufferSize   = 1 << 20
+)
+
+// TunnelConnectionOption acts as a configuration wrapper to our tunnel connection
+type TunnelConnectionOption func(connection *TunnelConnection)
+
+// NewTunnelConnection creates a tunnel connection object, but doesn't connect to the
+// websocket connection.
+func NewTunnelConnection(ctx context.Context, opts ...TunnelConnectionOption) (*TunnelConnection, error) {
+	tc := &TunnelConnection{}
+	tc.reconnectTimeout = defaultReconnectTimeout
+	tc.sendBufferSize = defaultSendBufferSize
+	tc.log = io.Discard
+	for _, opt := range opts {
+		opt(tc)
+	}
+	if tc.nic == "" {
+		tc.nic = defaultNetworkInterface
+	}
+	if tc.mtlsPolicy == MTLSAlways && tc.clientCertificate == nil {
+		return nil, ErrNoClientCertificate
+	}
+	if tc.skipInstanceCheck && tc.zone == "" {
+		return nil, ErrZoneRequired
+	}
+	var err error
+	tc.relayURL, err = parseRelayURL(tc.baseURL, tlsBaseUri)
+	if err != nil {
+		return nil, err
+	}
+	tc.mtlsRelayURL, err = parseRelayURL(tc.mtlsBaseURL, mtlsBaseUri)
+	if err != nil {
+		return nil, err
+	}
+	// the websocket package can't talk TLS to a proxy, unless the
+	// dialer is the caller's own its proxy is dialed by a proxyDialer
+	if tc.dialer == nil || tc.proxyURL != nil {
+		dialer, proxy := websocket.DefaultDialer, http.ProxyFromEnvironment
+		if tc.dialer != nil {
+			dialer = tc.dialer
+		}
+		if tc.proxyURL != nil {
+			proxy = http.ProxyURL(tc.proxyURL)
+		}
+		tc.dialer = newProxyDialer(*dialer, proxy, tc.proxyTLSConfig)
+	}
+	if tc.proxyURL != nil {
+		// the default credentials fetch tokens through the proxy too
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: tc.proxyTransport()})
+	}
+	if tc.tokenSource == nil {
+		ts, err := DefaultTokenSource(ctx)
+		if err != nil {
+			return nil, err
+		}
+		tc.tokenSource = ts
+	}
+	// sessions share the cache, a token is only fetched when the
+	// cached one is about to expire
+	tc.tokenSource = oauth2.ReuseTokenSource(nil, tc.tokenSource)
+	if tc.skipInstanceCheck {
+		return tc, nil
+	}
+	computeOpt := option.WithTokenSource(tc.tokenSource)
+	if tc.proxyURL != nil {
+		computeOpt = option.WithHTTPClient(&http.Client{
+			Transport: &oauth2.Transport{Source: tc.tokenSource, Base: tc.proxyTransport()},
+		})
+	}
+	var computeService *compute.Service
+	computeService, err = compute.NewService(context.Background(), append([]option.ClientOption{computeOpt}, tc.computeOptions...)...)
+	if err != nil {
+		return nil, err
+	}
+	instance, err := findInstance(ctx, computeService, tc.project, tc.zone, tc.instanceName)
+	if err != nil {
+		return nil, err
+	}
+	tc.zone = path.Base(instance.Zone)
+	err = validateTarget(instance, tc.nic)
+	if err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// newSession creates an unconnected tunnel connection to the same target,
+// each session gets its own websocket and SID.
+func (tc *TunnelConnection) newSession() *TunnelConnection {
+	return &TunnelConnection{tunnelConfig: tc.tunnelConfig}
+}
+
+// Connect connects to the websocket, duh.
+func (tc *TunnelConnection) Connect(ctx context.Context) error {
+	q := url.Values{}
+	q.Add("project", tc.project)
+	q.Add("zone", tc.zone)
+	q.Add("instance", tc.instanceName)
+	q.Add("interface", tc.nic)
+	q.Add("port", tc.port)
+	return tc.dial(ctx, connectEndpoint, q)
+}
+
+// Reconnect resumes the session after the websocket dropped, the ack tells IAP
+// how much we've received. IAP answers with a RECONNECT_SUCCESS_ACK frame
+// saying how much of our data it got.
+func (tc *TunnelConnection) Reconnect(ctx context.Context) error {
+	sid := tc.GetSid()
+	if sid == "" {
+		return errors.New("can't reconnect without a sid")
+	}
+	q := url.Values{}
+	q.Add("sid", sid)
+	q.Add("ack", strconv.FormatUint(tc.bytesReceived, 10))
+	if tc.zone != "" {
+		q.Add("zone", tc.zone)
+	}
+	err := tc.dial(ctx, reconnectEndpoint, q)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// dial opens the websocket to endpoint, replacing any previous one.
+func (tc *TunnelConnection) dial(ctx context.Context, endpoint string, q url.Values) error {
+	// every dial asks for a token, reconnects an hour in
+	// mustn't present the one the tunnel started with
+	token, err := tc.tokenSource.Token()
+	if err != nil {
+		return &AuthError{Err: fmt.Errorf("refreshing token: %w", err)}
+	}
+	header := http.Header{
+		"Origin":                 []string{origin},
+		"Sec-Websocket-Protocol": []string{subProtocolName},
+		"Authorization":          []string{fmt.Sprintf("Bearer %s", token.AccessToken)},
+	}
+	var c *websocket.Conn
+	if tc.mtlsPolicy != MTLSNever && tc.clientCertificate != nil {
+		var certErr error
+		tlsConfig := tc.clientTLSConfig()
+		tlsConfig.GetClientCertificate = func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tc.clientCertificate(cri)
+			certErr = err
+			return cert, err
+		}
+		var dialErr error
+		c, dialErr = tc.dialRelay(ctx, tc.mtlsRelayURL, endpoint, q, header, tlsConfig)
+		fallback, err := mtlsResult(tc.mtlsPolicy, certErr, dialErr)
+		if err != nil {
+			return err
+		}
+		if fallback {
+			reason := certErr
+			if reason == nil {
+				reason = dialErr
+			}
+			fmt.Fprintf(tc.log, "Falling back to the TLS endpoint, the mTLS one failed: %v\n", reason)
+			c = nil
+		}
+	}
+	if c == nil {
+		c, err = tc.dialRelay(ctx, tc.relayURL, endpoint, q, header, tc.tlsConfig)
+		if err != nil {
+			return err
+		}
+	}
+	tc.mu.Lock()
+	tc.websocketConn = c
+	tc.mu.Unlock()
+	return nil
+}
+
+// dialRelay opens a websocket to endpoint of the relay at base, a nil
+// tlsConfig leaves the dialer's own.
+func (tc *TunnelConnection) dialRelay(ctx context.Context, base *url.URL, endpoint string, q url.Values, header http.Header, tlsConfig *tls.Config) (*websocket.Conn, error) {
+	u := *base
+	u.Path = fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(base.Path, "/"), webSocketVersion, endpoint)
+	u.RawQuery = q.Encode()
+	dialer := *tc.dialer
+	if tlsConfig != nil {
+		dialer.TLSClientConfig = tlsConfig
+	}
+	c, resp, err := dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			return nil, &AuthError{Err: fmt.Errorf("%w: %s", err, resp.Status)}
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// clientTLSConfig returns a copy of the TLS config to add the client
+// certificate to.
+func (tc *TunnelConnection) clientTLSConfig() *tls.Config {
+	switch {
+	case tc.tlsConfig != nil:
+		return tc.tlsConfig.Clone()
+	case tc.dialer.TLSClientConfig != nil:
+		return tc.dialer.TLSClientConfig.Clone()
+	}
+	return &tls.Config{}
+}
+
+// parseRelayURL parses a relay base URL, an empty one is host with the
+// wss scheme.
+func parseRelayURL(baseURL, host string) (*url.URL, error) {
+	if baseURL == "" {
+		return &url.URL{Scheme: wssScheme, Host: host}, nil
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay URL: %w", err)
+	}
+	if (u.Scheme != "wss" && u.Scheme != "ws") || u.Host == "" || u.RawQuery != "" {
+		return nil, fmt.Errorf("invalid relay URL %q, expected wss://host[:port][/path]", baseURL)
+	}
+	return u, nil
+}
+
+// dropWebsocket closes the websocket without a close frame so the
+// session can still be resumed with Reconnect.
+func (tc *TunnelConnection) dropWebsocket() {
+	tc.mu.Lock()
+	ws := tc.websocketConn
+	tc.websocketConn = nil
+	tc.mu.Unlock()
+	if ws != nil {
+		ws.Close()
+	}
+}
+
+// Close closes the connection
+func (tc *TunnelConnection) Close() error {
+	ws := tc.ws()
+	if ws == nil {
+		return net.ErrClosed
+	}
+	tc.writeMu.Lock()
+	err := ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	tc.writeMu.Unlock()
+	tc.dropWebsocket()
+	return err
+}
+
+// readMessage reads the next binary message off of the websocket.
+func (tc *TunnelConnection) readMessage() ([]byte, error) {
+	ws := tc.ws()
+	if ws == nil {
+		return nil, net.ErrClosed
+	}
+	_, msg, err := ws.ReadMessage()
+	return msg, err
+}
+
+// writeMessage writes b as one binary message, a zero deadline means
+// the write doesn't time out.
+func (tc *TunnelConnection) writeMessage(b []byte, deadline time.Time) (int, error) {
+	ws := tc.ws()
+	if ws == nil {
+		return 0, net.ErrClosed
+	}
+	tc.writeMu.Lock()
+	defer tc.writeMu.Unlock()
+	err := ws.SetWriteDeadline(deadline)
+	if err != nil {
+		return 0, err
+	}
+	err = ws.WriteMessage(websocket.BinaryMessage, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (tc *TunnelConnection) ws() *websocket.Conn {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.websocketConn
+}
+
+func (tc *TunnelConnection) GetSid() string {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.sid
+}
+
+func (tc *TunnelConnection) SetSid(sid string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.sid = sid
+}
+
+func WithProject(project string) TunnelConnectionOption {
+	return func(tc *TunnelConnection) {
+		tc.project = project
+	}
+}
+
+func WithInstanceName(instanceName string) TunnelConnectionOption {
+	return func(tc *TunnelConnection) {
+		tc.instanceName = instanceName
+	}
+}
+
+// WithTunnelLogWriter sets where the tunnel says what it works around,
+// like falling back from the mTLS endpoint, nowhere by default. Orca
+// sets its own log writer.
+func WithTunnelLogWriter(w io.Writer) TunnelConnectionOption {
+	return func(tc *TunnelConnection) {
+		tc.log = w
+	}
+}
+
+// WithSkipInstanceCheck leaves out checking the instance is running and
+// has the network interface, which needs compute.instances.list. IAP
+// refuses the tunnel instead when it's wrong. The zone has to be given
+// with it, finding the instance needs the same permission.
+func WithSkipInstanceCheck(skip bool) TunnelConnectionOption {
+	return func(tc *TunnelConnection) {
+		tc.skipInstanceCheck = skip
+	}
+}
+
+// WithZone sets the zone of the instance, without it the zone is looked
+// up by the instance name.
+func WithZone(zone string) TunnelConnectionOption {
+	return func(tc *TunnelConnection) {
+		tc.zone = zone
+	}
+}
+
+func WithPort(port string) TunnelConnectionOption {
+	return func(tc *TunnelConnection) {
+		tc.port = port
+	}
+}
+
+func WithNic(nic string) TunnelConnectionOption {
+	return func(tc *TunnelConnection) {
+		tc.nic = nic
+	}
+}
+
+// WithReconnectTimeout sets how long a dropped websocket is retried for
+// before the tunnel gives up, zero or less disables reconnecting.
+func WithReconnectTimeout(timeout time.Duration) TunnelConnectionOption {
+	return func(tc *TunnelConnection) {
+		tc.reconnectTimeout = timeout
+	}
+}
+
+// WithSendBufferSize caps how many bytes of sent data are held until IAP
+// acks them, writes block once it's full.
+func WithSendBufferSize(size int) TunnelConnectionOption {
+	return func(tc *TunnelConnection) {
+		tc.sendBufferSize = size
+	}
+}
+
+// WithLatencyProbeInterval sends a latency probe every interval, the round
+// trip time is available from Conn.Latency. Probes are off by default.
+func WithLatencyProbeInterval(interval time.Duration) TunnelConnectionOption {
+	return func(tc *TunnelConnection) {
+		tc.latencyProbeInterval = interval
+	}
+}
+
+// WithTokenSource sets where the tunnel gets its bearer tokens from,
+// the application default credentials are used otherwise. Tokens are
+// cached and refreshed shortly before they expire.
+func WithTokenSource(ts oauth2.TokenSource) TunnelConnectionOption {
+	return func(tc *TunnelConnection) {
+		tc.tokenSource = ts
+	}
+}
+
+// WithBaseURL replaces wss://tunnel.cloudproxy.app, for a private or
+// regional endpoint or a proxy rewriting hostnames. The /v4/connect
+// path is added to it, ws:// is only meant for tests.
+func WithBaseURL(baseURL string) TunnelConnectionOption {
+	return func(tc *TunnelConnection) {
+		tc.baseURL = baseURL
+	}
+}
+
+// WithMTLSBaseURL replaces wss://mtls.tunnel.cloudproxy.app, the endpoint
+// used with a client certificate.
+func WithMTLSBaseURL(baseURL string) TunnelConnectionOption {
+	return func(tc *TunnelConnection) {
+		tc.mtlsBaseURL = baseURL
+	}
+}
+
+// WithTLSConfig sets the TLS config of the websocket, for other root CAs
+// or server name. The client certificate is added to a copy of it.
+func WithTLSConfig(config *tls.Config) TunnelConnectionOption {
+	return func(tc *TunnelConnection) {
+		tc.tlsConfig = config
+	}
+}
+
+// WithWebsocketDialer sets the dialer the websocket is opened with,
+// websocket.DefaultDialer otherwise. A config set with WithTLSConfig
+// takes the place of its TLSClientConfig and WithProxyURL of its Proxy,
+// otherwise its Proxy is used as is.
+func WithWebsocketDialer(dialer *websocket.Dialer) TunnelConnectionOption {
+	return func(tc *TunnelConnection) {
+		tc.dialer = dialer
+	}
+}
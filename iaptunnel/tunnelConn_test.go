@@ -0,0 +1,196 @@
+package iaptunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"github.com/eahrend/gcp-iap-tunnel-parser/iaptunnel/iaptest"
+	"io"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialEcho opens a tunnel with opts and checks a message makes it
+// through and back.
+func dialEcho(t *testing.T, opts ...TunnelConnectionOption) error {
+	t.Helper()
+	opts = append([]TunnelConnectionOption{WithProject("test-project"), WithZone("test-zone")}, opts...)
+	c, err := NewDialer(opts...).DialContext(context.Background(), "test-instance:22")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = c.Write([]byte("ping"))
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(c, buf)
+	if err != nil {
+		return err
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("echo = %q", buf)
+	}
+	return nil
+}
+
+// trusting returns a TLS config trusting the certificates of servers.
+func trusting(servers ...*iaptest.Server) *tls.Config {
+	roots := x509.NewCertPool()
+	for _, srv := range servers {
+		roots.AddCert(srv.Certificate())
+	}
+	return &tls.Config{RootCAs: roots}
+}
+
+func clientCertificate(t *testing.T) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test-device"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestWithTLSConfig(t *testing.T) {
+	srv := iaptest.NewTLSServer(startEchoBackend(t))
+	defer srv.Close()
+	err := dialEcho(t, withRelay(srv))
+	if err == nil {
+		t.Fatal("dialed a server with an unknown certificate authority")
+	}
+	err = dialEcho(t, withRelay(srv), WithTLSConfig(trusting(srv)))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMTLSPolicy(t *testing.T) {
+	tlsSrv := iaptest.NewTLSServer(startEchoBackend(t))
+	defer tlsSrv.Close()
+	mtlsSrv := iaptest.NewTLSServer(startEchoBackend(t))
+	defer mtlsSrv.Close()
+	cert := clientCertificate(t)
+	noCert := errors.New("no certificate on this device")
+	for _, tc := range []struct {
+		name   string
+		policy MTLSPolicy
+		source ClientCertificateSource
+		// want is the server the tunnel should end up on
+		want    *iaptest.Server
+		wantErr bool
+	}{
+		{"never", MTLSNever, staticCertificateSource(cert), tlsSrv, false},
+		{"auto", MTLSAuto, staticCertificateSource(cert), mtlsSrv, false},
+		{"auto without source", MTLSAuto, nil, tlsSrv, false},
+		{"auto falls back", MTLSAuto, func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return nil, noCert }, tlsSrv, false},
+		{"always", MTLSAlways, staticCertificateSource(cert), mtlsSrv, false},
+		{"always fails", MTLSAlways, func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return nil, noCert }, nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			before := map[*iaptest.Server]int{tlsSrv: len(tlsSrv.Connects()), mtlsSrv: len(mtlsSrv.Connects())}
+			opts := []TunnelConnectionOption{
+				withRelay(tlsSrv),
+				WithMTLSBaseURL(mtlsSrv.URL),
+				WithTLSConfig(trusting(tlsSrv, mtlsSrv)),
+				WithMTLSPolicy(tc.policy),
+			}
+			if tc.source != nil {
+				opts = append(opts, WithClientCertificateSource(tc.source))
+			}
+			err := dialEcho(t, opts...)
+			if tc.wantErr {
+				var authErr *AuthError
+				if !errors.As(err, &authErr) || !errors.Is(err, noCert) {
+					t.Fatalf("error = %v, want an AuthError wrapping the certificate error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			connects := tc.want.Connects()
+			if len(connects) != before[tc.want]+1 {
+				t.Fatal("the tunnel went to the wrong endpoint")
+			}
+			presented := connects[len(connects)-1].ClientCertificate != nil
+			if presented != (tc.want == mtlsSrv) {
+				t.Errorf("client certificate presented = %v", presented)
+			}
+		})
+	}
+}
+
+func TestMTLSEndpointDown(t *testing.T) {
+	tlsSrv := iaptest.NewTLSServer(startEchoBackend(t))
+	defer tlsSrv.Close()
+	mtlsSrv := iaptest.NewTLSServer(startEchoBackend(t))
+	mtlsSrv.Close()
+	opts := []TunnelConnectionOption{
+		withRelay(tlsSrv),
+		WithMTLSBaseURL(mtlsSrv.URL),
+		WithTLSConfig(trusting(tlsSrv)),
+		WithClientCertificateSource(staticCertificateSource(clientCertificate(t))),
+	}
+	var log bytes.Buffer
+	err := dialEcho(t, append(opts, WithMTLSPolicy(MTLSAuto), WithTunnelLogWriter(&log))...)
+	if err != nil {
+		t.Fatalf("auto didn't fall back: %v", err)
+	}
+	if !strings.Contains(log.String(), "Falling back to the TLS endpoint") {
+		t.Errorf("falling back wasn't logged: %q", log.String())
+	}
+	err = dialEcho(t, append(opts, WithMTLSPolicy(MTLSAlways))...)
+	var mtlsErr *MTLSError
+	if !errors.As(err, &mtlsErr) {
+		t.Errorf("always = %v, want an MTLSError", err)
+	}
+}
+
+func TestParseRelayURL(t *testing.T) {
+	for _, tc := range []struct {
+		baseURL string
+		want    string
+		wantErr bool
+	}{
+		{"", "wss://tunnel.cloudproxy.app", false},
+		{"wss://tunnel.example.com", "wss://tunnel.example.com", false},
+		{"wss://psc.example.com:8443/iap", "wss://psc.example.com:8443/iap", false},
+		{"ws://127.0.0.1:1234", "ws://127.0.0.1:1234", false},
+		{"https://tunnel.example.com", "", true},
+		{"wss:///no-host", "", true},
+		{"wss://tunnel.example.com?x=1", "", true},
+	} {
+		u, err := parseRelayURL(tc.baseURL, tlsBaseUri)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseRelayURL(%q) = %v, want an error", tc.baseURL, u)
+			}
+			continue
+		}
+		if err != nil || u.String() != tc.want {
+			t.Errorf("parseRelayURL(%q) = %v, %v, want %s", tc.baseURL, u, err, tc.want)
+		}
+	}
+}
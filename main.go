@@ -2,13 +2,75 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
+const progName = "iap-tunnel"
+
+// command is a subcommand, run gets the arguments after its name.
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, args []string) error
+}
+
+var commands = []command{
+	{"start-tunnel", "listen on a local port and tunnel every client to an instance port", startTunnel},
+	{"start-tunnels", "run every tunnel listed in a YAML config file", startTunnels},
+	{"ssh-proxy", "tunnel stdin and stdout to an instance port, for ssh's ProxyCommand", sshProxy},
+	{"list-targets", "list the instances that can be tunneled to", listTargets},
+	{"version", "print the version", printVersion},
+}
+
 func main() {
-	ctx := context.Background()
-	orca, err := NewOrca(ctx)
-	if err != nil {
-		panic(err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err := run(ctx, os.Args[1:])
+	var usageErr *usageError
+	var settingErr *settingError
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+	case errors.As(err, &usageErr), errors.As(err, &settingErr):
+		fmt.Fprintf(os.Stderr, "%s: %v\nRun '%s help' for usage.\n", progName, err, progName)
+		os.Exit(2)
+	default:
+		fmt.Fprintf(os.Stderr, "%s: %v\n", progName, err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		// before there were subcommands the tunnel was started from
+		// environment variables alone, keep that working
+		if os.Getenv("INSTANCE") != "" {
+			return startTunnel(ctx, nil)
+		}
+		usage()
+		return &usageError{errors.New("no command given")}
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		usage()
+		return nil
+	}
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(ctx, args[1:])
+		}
+	}
+	return &usageError{fmt.Errorf("unknown command %q", args[0])}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [arguments]\n\nCommands:\n", progName)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", cmd.name, cmd.summary)
 	}
-	panic(orca.Run())
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", progName)
 }